@@ -19,10 +19,16 @@ const (
 	CONTENT_TYPE_STRING = "text/plain;charset=utf-8"
 )
 
+// UfopRequest 表示 UFOP转发请求体，其中 MimeType 为 Url 所指定资源的 Content-Type，
+// 当 Url 为空时，源数据来自请求体，MimeType 和 ContentLength 为请求体的 Content-Type 和长度
+// Job 用来记录请求的处理进度，请求被取消时处理程序应当尽快结束处理
 type UfopRequest struct {
-	Cmd   string `json:"cmd"`
-	Url   string `json:"url"`
-	ReqId string `json:"-"`
+	Cmd           string   `json:"cmd"`
+	Url           string   `json:"url"`
+	MimeType      string   `json:"-"`
+	ContentLength int64    `json:"-"`
+	Job           *UfopJob `json:"-"`
+	ReqId         string   `json:"-"`
 }
 
 type UfopError struct {
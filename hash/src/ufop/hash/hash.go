@@ -10,7 +10,6 @@ import (
 	"fmt"
 	"hash"
 	"io"
-	"net/http"
 	"os"
 	"regexp"
 	"strings"
@@ -81,33 +80,22 @@ func (this *Hasher) Do(req ufop.UfopRequest, reqBody io.ReadCloser) (result inte
 		h = sha1.New()
 	}
 
-	var hashResult string
-
-	if req.Url != "" {
-		//check url
-		respBody, respErr := http.Get(req.Url)
-		if respErr != nil {
-			err = fmt.Errorf("get source content error, %s", respErr.Error())
-			return
-		}
-		defer respBody.Body.Close()
-
-		_, cpErr := io.Copy(h, respBody.Body)
-		if cpErr != nil {
-			err = fmt.Errorf("read source content error, %s", cpErr)
-		}
-
-		hashResult = hex.EncodeToString(h.Sum(nil))
-	} else {
-		//check reqBody
-		_, cpErr := io.Copy(h, reqBody)
-		if cpErr != nil {
-			err = fmt.Errorf("read source content error, %s", cpErr)
-		}
+	//get resource from url or request body
+	src, srcErr := ufop.OpenSource(req, reqBody)
+	if srcErr != nil {
+		err = srcErr
+		return
+	}
+	defer src.Close()
 
-		hashResult = hex.EncodeToString(h.Sum(nil))
+	_, cpErr := io.Copy(h, src.Body)
+	if cpErr != nil {
+		err = fmt.Errorf("read source content error, %s", cpErr)
+		return
 	}
 
+	hashResult := hex.EncodeToString(h.Sum(nil))
+
 	if this.outputFormat == "json" {
 		if hashType == "md5" {
 			result = struct {
@@ -0,0 +1,61 @@
+package ufop
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/qiniu/log"
+)
+
+/*
+
+GET  /admin/jobs                   list the in-flight requests
+POST /admin/jobs/cancel?reqId=<id> cancel the request
+
+the requests must be authorized by the header 'Authorization: Bearer <admin_token>'
+
+*/
+func (this *UfopServer) serveAdminJobs(w http.ResponseWriter, req *http.Request) {
+	if !this.checkAdmin(w, req) {
+		return
+	}
+	if req.Method != "GET" {
+		writeJsonError(w, 405, "method not allowed")
+		return
+	}
+	writeJsonResult(w, 200, this.jobs.List())
+}
+
+func (this *UfopServer) serveAdminCancelJob(w http.ResponseWriter, req *http.Request) {
+	if !this.checkAdmin(w, req) {
+		return
+	}
+	if req.Method != "POST" {
+		writeJsonError(w, 405, "method not allowed")
+		return
+	}
+
+	req.ParseForm()
+	reqId := req.Form.Get("reqId")
+	if reqId == "" {
+		writeJsonError(w, 400, "no reqId specified")
+		return
+	}
+	if !this.jobs.Cancel(reqId) {
+		writeJsonError(w, 404, "no such job")
+		return
+	}
+	log.Infof("[%s] job cancelled by admin from %s", reqId, req.RemoteAddr)
+	writeJsonResult(w, 200, map[string]string{"reqId": reqId})
+}
+
+func (this *UfopServer) checkAdmin(w http.ResponseWriter, req *http.Request) bool {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if this.cfg.AdminToken == "" ||
+		subtle.ConstantTimeCompare([]byte(token), []byte(this.cfg.AdminToken)) != 1 {
+		writeJsonError(w, 401, "unauthorized")
+		return false
+	}
+	return true
+}
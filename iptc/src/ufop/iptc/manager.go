@@ -81,7 +81,6 @@ import (
 	"fmt"
 	"image/jpeg"
 	"io"
-	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -146,42 +145,31 @@ func (m *IptcManager) Do(req ufop.UfopRequest, ufopBody io.ReadCloser) (result i
 	}
 
 	log.Infof("[%s] image iptc cmd `%s` with param `%s`", reqId, iptcCmd, iptcParam)
-	imageURL := req.Url
-	jobID := utils.Md5Hex(fmt.Sprintf("%s%d", imageURL, time.Now().UnixNano()))
+	jobID := utils.Md5Hex(fmt.Sprintf("%s%d", reqId, time.Now().UnixNano()))
 	imageFile := filepath.Join(os.TempDir(), "src_"+jobID)
 	defer os.Remove(imageFile)
 
-	//download image
-	resp, respErr := http.Get(imageURL)
-	if respErr != nil {
-		err = fmt.Errorf("get image failed: %s", respErr.Error())
+	//get image from url or request body
+	src, srcErr := ufop.OpenSource(req, ufopBody)
+	if srcErr != nil {
+		err = fmt.Errorf("get image failed: %s", srcErr.Error())
 		return
 	}
+	defer src.Close()
+
 	//check mimetype
-	//reqMime := resp.Header.Get("Content-Type")
-	reqMime := req.MimeType
+	reqMime := src.MimeType
 	log.Infof("[%s] Content-Type: %s", reqId, reqMime)
 	if reqMime != "image/jpeg" && reqMime != "image/jpg" {
 		err = fmt.Errorf("unsupported image file with mimetype %s", reqMime)
-		//close boy
-		resp.Body.Close()
 		return
 	}
 
 	//write file to local disk
-	writeFp, openErr := os.Create(imageFile)
-	if openErr != nil {
-		err = fmt.Errorf("open local image file error, %s", openErr.Error())
-		return
-	}
-	_, cpErr := io.Copy(writeFp, resp.Body)
-	resp.Body.Close()
-	if cpErr != nil {
-		err = fmt.Errorf("save local image file error, %s", cpErr.Error())
-		writeFp.Close()
+	if saveErr := src.SaveTo(imageFile); saveErr != nil {
+		err = fmt.Errorf("save local image file error, %s", saveErr.Error())
 		return
 	}
-	writeFp.Close()
 
 	if iptcCmd == "view" {
 		return m.getIptcInfo(reqId, imageFile)
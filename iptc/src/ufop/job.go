@@ -0,0 +1,175 @@
+package ufop
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	JOB_PHASE_PROCESSING  = "processing"
+	JOB_PHASE_DOWNLOADING = "downloading"
+	JOB_PHASE_EXTRACTING  = "extracting"
+	JOB_PHASE_UPLOADING   = "uploading"
+)
+
+var ErrJobCancelled = errors.New("job cancelled")
+
+// UfopJob 表示正在处理中的请求，用来查看请求的处理进度和取消请求，
+// 处理命令时可以安全地调用 nil 的 UfopJob 的各个方法
+type UfopJob struct {
+	ReqId     string
+	Cmd       string
+	StartTime time.Time
+
+	bytesProcessed int64
+	phase          atomic.Value
+	ctx            context.Context
+	cancel         context.CancelFunc
+}
+
+// UfopJobInfo 为管理接口中返回的请求信息
+type UfopJobInfo struct {
+	ReqId          string    `json:"reqId"`
+	Cmd            string    `json:"cmd"`
+	StartTime      time.Time `json:"startTime"`
+	BytesProcessed int64     `json:"bytesProcessed"`
+	Phase          string    `json:"phase"`
+}
+
+func NewJob(reqId, cmd string) *UfopJob {
+	job := &UfopJob{
+		ReqId:     reqId,
+		Cmd:       cmd,
+		StartTime: time.Now(),
+	}
+	job.phase.Store(JOB_PHASE_PROCESSING)
+	job.ctx, job.cancel = context.WithCancel(context.Background())
+	return job
+}
+
+func (this *UfopJob) SetPhase(phase string) {
+	if this == nil {
+		return
+	}
+	this.phase.Store(phase)
+}
+
+func (this *UfopJob) AddBytes(n int64) {
+	if this == nil {
+		return
+	}
+	atomic.AddInt64(&this.bytesProcessed, n)
+}
+
+// the context is done when the job is cancelled
+func (this *UfopJob) Context() context.Context {
+	if this == nil {
+		return context.Background()
+	}
+	return this.ctx
+}
+
+// return ErrJobCancelled when the job is cancelled
+func (this *UfopJob) Err() error {
+	if this == nil || this.ctx.Err() == nil {
+		return nil
+	}
+	return ErrJobCancelled
+}
+
+func (this *UfopJob) Cancel() {
+	if this == nil {
+		return
+	}
+	this.cancel()
+}
+
+// wrap the reader to count the bytes processed, and stop reading when the job is cancelled
+func (this *UfopJob) Reader(reader io.Reader) io.Reader {
+	if this == nil {
+		return reader
+	}
+	return &ufopJobReader{
+		job:    this,
+		reader: reader,
+	}
+}
+
+func (this *UfopJob) Info() UfopJobInfo {
+	return UfopJobInfo{
+		ReqId:          this.ReqId,
+		Cmd:            this.Cmd,
+		StartTime:      this.StartTime,
+		BytesProcessed: atomic.LoadInt64(&this.bytesProcessed),
+		Phase:          this.phase.Load().(string),
+	}
+}
+
+type ufopJobReader struct {
+	job    *UfopJob
+	reader io.Reader
+}
+
+func (this *ufopJobReader) Read(p []byte) (n int, err error) {
+	if err = this.job.Err(); err != nil {
+		return
+	}
+	n, err = this.reader.Read(p)
+	this.job.AddBytes(int64(n))
+	return
+}
+
+// UfopJobRegistry 记录所有正在处理中的请求
+type UfopJobRegistry struct {
+	lock sync.Mutex
+	jobs map[string]*UfopJob
+}
+
+func NewJobRegistry() *UfopJobRegistry {
+	return &UfopJobRegistry{
+		jobs: make(map[string]*UfopJob),
+	}
+}
+
+func (this *UfopJobRegistry) Add(job *UfopJob) {
+	this.lock.Lock()
+	this.jobs[job.ReqId] = job
+	this.lock.Unlock()
+}
+
+func (this *UfopJobRegistry) Remove(reqId string) {
+	this.lock.Lock()
+	delete(this.jobs, reqId)
+	this.lock.Unlock()
+}
+
+// list the jobs in the order of start time
+func (this *UfopJobRegistry) List() []UfopJobInfo {
+	this.lock.Lock()
+	jobInfos := make([]UfopJobInfo, 0, len(this.jobs))
+	for _, job := range this.jobs {
+		jobInfos = append(jobInfos, job.Info())
+	}
+	this.lock.Unlock()
+
+	sort.Slice(jobInfos, func(i, j int) bool {
+		return jobInfos[i].StartTime.Before(jobInfos[j].StartTime)
+	})
+	return jobInfos
+}
+
+// cancel the job, return false if no such job
+func (this *UfopJobRegistry) Cancel(reqId string) bool {
+	this.lock.Lock()
+	job, ok := this.jobs[reqId]
+	this.lock.Unlock()
+	if ok {
+		job.Cancel()
+	}
+	return ok
+}
@@ -1,10 +1,13 @@
 package ufop
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/qiniu/log"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"io"
 	"net/http"
 	"os"
@@ -16,12 +19,16 @@ import (
 type UfopServer struct {
 	cfg         *UfopConfig
 	jobHandlers map[string]UfopJobHandler
+	notifier    *UfopNotifier
+	jobs        *UfopJobRegistry
 }
 
 func NewServer(cfg *UfopConfig) *UfopServer {
 	serv := UfopServer{}
 	serv.cfg = cfg
 	serv.jobHandlers = make(map[string]UfopJobHandler, 0)
+	serv.notifier = NewNotifier(cfg)
+	serv.jobs = NewJobRegistry()
 	return &serv
 }
 
@@ -44,6 +51,10 @@ func (this *UfopServer) Listen() {
 	//define handler
 	http.HandleFunc("/handler", this.serveUfop)
 	http.HandleFunc("/health", this.serveHealth)
+	if this.cfg.AdminToken != "" {
+		http.HandleFunc("/admin/jobs", this.serveAdminJobs)
+		http.HandleFunc("/admin/jobs/cancel", this.serveAdminCancelJob)
+	}
 
 	//bind and listen
 	endPoint := fmt.Sprintf("%s:%d", this.cfg.ListenHost, this.cfg.ListenPort)
@@ -54,7 +65,34 @@ func (this *UfopServer) Listen() {
 		MaxHeaderBytes: this.cfg.MaxHeaderBytes,
 	}
 
-	listenErr := ufopServer.ListenAndServe()
+	var listenErr error
+	if this.cfg.TlsCertFile != "" || this.cfg.TlsKeyFile != "" {
+		tlsLoader, tlsErr := NewTlsLoader(this.cfg)
+		if tlsErr != nil {
+			log.Println(tlsErr)
+			return
+		}
+
+		nextProtos := []string{"http/1.1"}
+		if this.cfg.Http2 {
+			nextProtos = []string{"h2", "http/1.1"}
+			ufopServer.TLSConfig = tlsLoader.TlsConfig(nextProtos)
+			if h2Err := http2.ConfigureServer(ufopServer, &http2.Server{}); h2Err != nil {
+				log.Println(h2Err)
+				return
+			}
+		} else {
+			//disable the http/2 enabled by default
+			ufopServer.TLSConfig = tlsLoader.TlsConfig(nextProtos)
+			ufopServer.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		}
+		listenErr = ufopServer.ListenAndServeTLS("", "")
+	} else {
+		if this.cfg.H2c {
+			ufopServer.Handler = h2c.NewHandler(http.DefaultServeMux, &http2.Server{})
+		}
+		listenErr = ufopServer.ListenAndServe()
+	}
 	if listenErr != nil {
 		log.Println(listenErr)
 	}
@@ -81,22 +119,45 @@ func (this *UfopServer) serveUfop(w http.ResponseWriter, req *http.Request) {
 	var ufopResult interface{}
 	var ufopResultType int
 	var ufopResultContentType string
+	defer this.recoverServe(w, &ufopReq)
 
 	//parse form and set url
 	req.ParseForm()
 	ufopReq.Cmd = req.Form.Get("cmd")
 	ufopReq.Url = req.Form.Get("url")
 	ufopReq.MimeType = req.Header.Get("Content-Type")
+	ufopReq.ContentLength = req.ContentLength
 
 	reqId := utils.NewRequestId()
 	ufopReq.ReqId = reqId
 
+	//get the notify url and strip it from the cmd
+	notifyUrl, ufopCmd, nErr := this.notifier.parse(ufopReq.Cmd)
+	if nErr != nil {
+		log.Errorf("[%s] %s", reqId, nErr.Error())
+		writeJsonError(w, 400, nErr.Error())
+		return
+	}
+	ufopReq.Cmd = ufopCmd
+
+	//track the job so that it can be listed and cancelled by the admin api
+	ufopReq.Job = NewJob(reqId, ufopReq.Cmd)
+	this.jobs.Add(ufopReq.Job)
+	defer this.jobs.Remove(reqId)
+	defer ufopReq.Job.Cancel()
+
 	ufopReqStr, _ := json.Marshal(&ufopReq)
 	log.Infof("[%s] %s", reqId, string(ufopReqStr))
 
 	ufopResult, ufopResultType, ufopResultContentType, err =
 		handleJob(ufopReq, req.Body, this.cfg.UfopPrefix, this.jobHandlers)
-	if err != nil {
+	if notifyUrl != "" {
+		this.notifyJob(notifyUrl, ufopReq, ufopResult, ufopResultType, ufopResultContentType, err)
+	}
+	if panicErr, ok := err.(*UfopPanicError); ok {
+		this.reportPanic(panicErr, ufopReq)
+		writeJsonPanicError(w, panicErr)
+	} else if err != nil {
 		log.Errorf("[%s] %s", reqId, err.Error())
 		writeJsonError(w, 400, err.Error())
 	} else {
@@ -113,6 +174,29 @@ func (this *UfopServer) serveUfop(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func (this *UfopServer) notifyJob(notifyUrl string, ufopReq UfopRequest, result interface{}, resultType int,
+	contentType string, err error) {
+	notification := UfopNotification{
+		ReqId: ufopReq.ReqId,
+		Cmd:   ufopReq.Cmd,
+		Url:   ufopReq.Url,
+	}
+	if _, ok := err.(*UfopPanicError); ok {
+		notification.Code = 500
+		notification.Error = PANIC_ERROR_MESSAGE
+	} else if err != nil {
+		notification.Code = 400
+		notification.Error = err.Error()
+	} else {
+		notification.Code = 200
+		notification.ContentType = contentType
+		if resultType == RESULT_TYPE_JSON {
+			notification.Result = result
+		}
+	}
+	this.notifier.Notify(notifyUrl, notification)
+}
+
 func handleJob(ufopReq UfopRequest, ufopBody io.ReadCloser, ufopPrefix string,
 	jobHandlers map[string]UfopJobHandler) (interface{}, int, string, error) {
 	defer ufopBody.Close()
@@ -126,7 +210,7 @@ func handleJob(ufopReq UfopRequest, ufopBody io.ReadCloser, ufopPrefix string,
 	fop := items[0]
 	if jobHandler, ok := jobHandlers[fop]; ok {
 		ufopReq.Cmd = strings.TrimPrefix(ufopReq.Cmd, ufopPrefix)
-		ufopResult, resultType, contentType, err = jobHandler.Do(ufopReq, ufopBody)
+		ufopResult, resultType, contentType, err = doJob(jobHandler, ufopReq, ufopBody)
 	} else {
 		err = errors.New("no fop available for the request")
 	}
@@ -164,16 +248,20 @@ func writeJsonResult(w http.ResponseWriter, statusCode int, result interface{})
 }
 
 func writeOctetResultFromBytes(w http.ResponseWriter, result interface{}, mimeType string) {
+	respData, ok := result.([]byte)
+	if !ok {
+		log.Errorf("invalid octet bytes result type %T", result)
+		writeJsonError(w, 500, "invalid octet bytes result")
+		return
+	}
 	if mimeType != "" {
 		w.Header().Set("Content-Type", mimeType)
 	} else {
 		w.Header().Set("Content-Type", CONTENT_TYPE_OCTET)
 	}
-	if respData := result.([]byte); respData != nil {
-		_, err := w.Write(respData)
-		if err != nil {
-			log.Error("write octet from bytes error", err)
-		}
+	_, err := w.Write(respData)
+	if err != nil {
+		log.Error("write octet from bytes error", err)
 	}
 }
 
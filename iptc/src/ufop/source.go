@@ -0,0 +1,184 @@
+package ufop
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+const (
+	SOURCE_CACHE_THRESHOLD int64 = 20 * 1024 * 1024 //20MB
+)
+
+var ErrSourceTooLarge = errors.New("source data length exceeds the limit")
+
+// UfopSource 表示待处理的源数据，来自 req.Url 所指定的资源，或者在 req.Url 为空时来自请求体，
+// ETag 为资源响应中的 ETag，用来识别资源是否变化，来自请求体或者源站没有返回时为空
+type UfopSource struct {
+	Body     io.ReadCloser
+	Size     int64
+	MimeType string
+	ETag     string
+}
+
+// UfopCachedSource 表示已经缓存到内存或者本地磁盘的源数据，支持随机读取
+type UfopCachedSource struct {
+	io.ReaderAt
+	Size     int64
+	MimeType string
+
+	localFp *os.File
+}
+
+func OpenSource(req UfopRequest, ufopBody io.ReadCloser) (src *UfopSource, err error) {
+	if req.Url != "" {
+		req.Job.SetPhase(JOB_PHASE_DOWNLOADING)
+		var resp *http.Response
+		httpReq, respErr := http.NewRequest("GET", req.Url, nil)
+		if respErr == nil {
+			resp, respErr = http.DefaultClient.Do(httpReq.WithContext(req.Job.Context()))
+		}
+		if respErr != nil || resp.StatusCode != http.StatusOK {
+			if respErr != nil {
+				err = fmt.Errorf("retrieve resource data failed, %s", respErr.Error())
+			} else {
+				err = fmt.Errorf("retrieve resource data failed, %s", resp.Status)
+				if resp.Body != nil {
+					resp.Body.Close()
+				}
+			}
+			return
+		}
+
+		src = &UfopSource{
+			Body:     newJobReadCloser(req.Job, resp.Body),
+			Size:     resp.ContentLength,
+			MimeType: req.MimeType,
+			ETag:     resp.Header.Get("ETag"),
+		}
+		if src.MimeType == "" {
+			src.MimeType = resp.Header.Get("Content-Type")
+		}
+		return
+	}
+
+	//read from request body, the empty body is valid source data
+	if ufopBody == nil {
+		err = errors.New("no resource url or request body specified")
+		return
+	}
+
+	req.Job.SetPhase(JOB_PHASE_DOWNLOADING)
+	src = &UfopSource{
+		Body:     newJobReadCloser(req.Job, ufopBody),
+		Size:     req.ContentLength,
+		MimeType: req.MimeType,
+	}
+	return
+}
+
+type jobReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// count the bytes read from the source, and stop reading when the job is cancelled
+func newJobReadCloser(job *UfopJob, body io.ReadCloser) io.ReadCloser {
+	return &jobReadCloser{
+		Reader: job.Reader(body),
+		Closer: body,
+	}
+}
+
+func (this *UfopSource) Close() error {
+	return this.Body.Close()
+}
+
+// cache the source data into memory, or into local disk when it is large or the size is unknown
+func (this *UfopSource) Cache(maxLength int64) (cached *UfopCachedSource, err error) {
+	if maxLength > 0 && this.Size > maxLength {
+		err = ErrSourceTooLarge
+		return
+	}
+
+	var srcReader io.Reader = this.Body
+	if maxLength > 0 {
+		srcReader = io.LimitReader(this.Body, maxLength+1)
+	}
+
+	if this.Size >= 0 && this.Size <= SOURCE_CACHE_THRESHOLD {
+		srcData, readErr := ioutil.ReadAll(srcReader)
+		if readErr != nil {
+			err = fmt.Errorf("read resource data failed, %s", readErr.Error())
+			return
+		}
+		if maxLength > 0 && int64(len(srcData)) > maxLength {
+			err = ErrSourceTooLarge
+			return
+		}
+
+		cached = &UfopCachedSource{
+			ReaderAt: bytes.NewReader(srcData),
+			Size:     int64(len(srcData)),
+			MimeType: this.MimeType,
+		}
+		return
+	}
+
+	localFp, openErr := ioutil.TempFile("", "ufop_src_")
+	if openErr != nil {
+		err = fmt.Errorf("open local cache file failed, %s", openErr.Error())
+		return
+	}
+
+	srcSize, cpErr := io.Copy(localFp, srcReader)
+	if cpErr != nil {
+		localFp.Close()
+		os.Remove(localFp.Name())
+		err = fmt.Errorf("write local cache file failed, %s", cpErr.Error())
+		return
+	}
+	if maxLength > 0 && srcSize > maxLength {
+		localFp.Close()
+		os.Remove(localFp.Name())
+		err = ErrSourceTooLarge
+		return
+	}
+
+	cached = &UfopCachedSource{
+		ReaderAt: localFp,
+		Size:     srcSize,
+		MimeType: this.MimeType,
+		localFp:  localFp,
+	}
+	return
+}
+
+// save the source data to the local path
+func (this *UfopSource) SaveTo(localPath string) (err error) {
+	localFp, openErr := os.Create(localPath)
+	if openErr != nil {
+		err = fmt.Errorf("open local file failed, %s", openErr.Error())
+		return
+	}
+	defer localFp.Close()
+
+	_, cpErr := io.Copy(localFp, this.Body)
+	if cpErr != nil {
+		err = fmt.Errorf("save resource data to local file failed, %s", cpErr.Error())
+		return
+	}
+	return
+}
+
+func (this *UfopCachedSource) Close() (err error) {
+	if this.localFp != nil {
+		err = this.localFp.Close()
+		os.Remove(this.localFp.Name())
+	}
+	return
+}
@@ -25,8 +25,32 @@ type UfopConfig struct {
 
 	MaxHeaderBytes int `json:"max_header_bytes,omitempty"`
 
+	//serve with tls when the cert and key are set, the client certificates are verified when the client ca is set
+	TlsCertFile       string `json:"tls_cert_file,omitempty"`
+	TlsKeyFile        string `json:"tls_key_file,omitempty"`
+	TlsClientCaFile   string `json:"tls_client_ca_file,omitempty"`
+	TlsReloadInterval int    `json:"tls_reload_interval,omitempty"`
+
+	//enable http/2 over tls, or h2c (http/2 without tls) when tls is not set
+	Http2 bool `json:"http2,omitempty"`
+	H2c   bool `json:"h2c,omitempty"`
+
+	//write the crash report files of the panics into the dir
+	CrashReportDir string `json:"crash_report_dir,omitempty"`
+
+	//token to access the admin api, the admin api is disabled when not set
+	AdminToken string `json:"admin_token,omitempty"`
+
 	//make you ufop instance name unique
 	UfopPrefix string `json:"ufop_prefix"`
+
+	//notify the job result to the url when the job finishes, the notification is signed by the secret,
+	//the notify url specified in the cmd must be on one of the notify hosts
+	NotifyUrl        string   `json:"notify_url,omitempty"`
+	NotifySecret     string   `json:"notify_secret,omitempty"`
+	NotifyHosts      []string `json:"notify_hosts,omitempty"`
+	NotifyMaxRetries int      `json:"notify_max_retries,omitempty"`
+	NotifyTimeout    int      `json:"notify_timeout,omitempty"`
 }
 
 func (this *UfopConfig) LoadFromFile(configFilePath string) (err error) {
@@ -41,6 +65,11 @@ func (this *UfopConfig) LoadFromFile(configFilePath string) (err error) {
 	decodeErr := decoder.Decode(this)
 	if decodeErr != nil {
 		err = errors.New(fmt.Sprintf("Parse ufop config failed, %s", decodeErr))
+		return
+	}
+	if (this.NotifyUrl != "" || len(this.NotifyHosts) > 0) && this.NotifySecret == "" {
+		err = errors.New("Invalid ufop config, 'notify_secret' is required to notify the job result")
+		return
 	}
 	if this.ListenPort <= 0 {
 		this.ListenPort = defaultUfopConfig.ListenPort
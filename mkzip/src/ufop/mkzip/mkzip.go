@@ -8,9 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/qiniu/api.v6/auth/digest"
-	"github.com/qiniu/api.v6/rs"
 	"github.com/qiniu/log"
-	"github.com/qiniu/rpc"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -19,6 +17,7 @@ import (
 	"regexp"
 	"strings"
 	"ufop"
+	"ufop/store"
 	"ufop/utils"
 )
 
@@ -30,18 +29,25 @@ mkzip
 /url/<encoded url>/alias/<encoded alias>
 /url/<encoded url>/alias/<encoded alias>
 /ignore404/(0|1)
+
+when no url is specified, the url & alias list is read from the index file in url or request body
 */
 
+var urlAliasRegx = regexp.MustCompile("url/[0-9a-zA-Z-_=]+(/alias/[0-9a-zA-Z-_=]+){0,1}")
+
 const (
-	MKZIP_MAX_FILE_LENGTH int64 = 100 * 1024 * 1024 //100MB
-	MKZIP_MAX_FILE_COUNT  int   = 100               //100
-	MKZIP_MAX_FILE_LIMIT  int   = 1000              //1000
+	MKZIP_MAX_FILE_LENGTH  int64 = 100 * 1024 * 1024 //100MB
+	MKZIP_MAX_FILE_COUNT   int   = 100               //100
+	MKZIP_MAX_FILE_LIMIT   int   = 1000              //1000
+	MKZIP_MAX_INDEX_LENGTH int64 = 1024 * 1024       //1MB
 )
 
 type Mkzipper struct {
-	mac           *digest.Mac
-	maxFileLength int64
-	maxFileCount  int
+	mac            *digest.Mac
+	storeConfig    store.StoreConfig
+	uptokenManager *store.UptokenManager
+	maxFileLength  int64
+	maxFileCount   int
 }
 
 type MkzipperConfig struct {
@@ -51,6 +57,9 @@ type MkzipperConfig struct {
 
 	MkzipMaxFileLength int64 `json:"mkzip_max_file_length,omitempty"`
 	MkzipMaxFileCount  int   `json:"mkzip_max_file_count,omitempty"`
+
+	//store where the files to zip are saved, default is qiniu
+	store.StoreConfig
 }
 
 type ZipFile struct {
@@ -90,13 +99,20 @@ func (this *Mkzipper) InitConfig(jobConf string) (err error) {
 		this.maxFileLength = config.MkzipMaxFileLength
 	}
 
+	if checkErr := config.StoreConfig.Check(); checkErr != nil {
+		err = fmt.Errorf("Invalid mkzip store config, %s", checkErr.Error())
+		return
+	}
+	this.storeConfig = config.StoreConfig
+
 	this.mac = &digest.Mac{config.AccessKey, []byte(config.SecretKey)}
+	this.uptokenManager = store.NewUptokenManager(&this.storeConfig, this.mac)
 
 	return
 }
 
 func (this *Mkzipper) parse(cmd string) (bucket string, encoding string, zipFiles []ZipFile, ignore404 bool, err error) {
-	pattern := "^mkzip/bucket/[0-9a-zA-Z-_=]+(/encoding/[0-9a-zA-Z-_=]+){0,1}(/url/[0-9a-zA-Z-_=]+(/alias/[0-9a-zA-Z-_=]+){0,1})+(/ignore404/(0|1)){0,1}$"
+	pattern := "^mkzip/bucket/[0-9a-zA-Z-_=]+(/encoding/[0-9a-zA-Z-_=]+){0,1}(/url/[0-9a-zA-Z-_=]+(/alias/[0-9a-zA-Z-_=]+){0,1})*(/ignore404/(0|1)){0,1}$"
 	matched, _ := regexp.MatchString(pattern, cmd)
 	if !matched {
 		err = errors.New("invalid mkzip command format")
@@ -116,6 +132,15 @@ func (this *Mkzipper) parse(cmd string) (bucket string, encoding string, zipFile
 		err = errors.New("invalid mkzip parameter 'encoding'")
 		return
 	}
+	if encoding == "" {
+		encoding = utils.CHARSET_UTF8
+	} else {
+		encoding, err = utils.LookupCharset(encoding)
+		if err != nil {
+			err = fmt.Errorf("invalid mkzip parameter 'encoding', %s", err.Error())
+			return
+		}
+	}
 
 	ignore404Str := utils.GetParam(cmd, "ignore404/(0|1)", "ignore404")
 	if ignore404Str == "1" {
@@ -123,8 +148,32 @@ func (this *Mkzipper) parse(cmd string) (bucket string, encoding string, zipFile
 	}
 
 	//get url & alias
-	urlAliasRegx := regexp.MustCompile("url/[0-9a-zA-Z-_=]+(/alias/[0-9a-zA-Z-_=]+){0,1}")
 	urlAliasPairs := urlAliasRegx.FindAllString(cmd, -1)
+	zipFiles, err = this.parseZipFiles(urlAliasPairs)
+	return
+}
+
+// read the url & alias list from the index file, each line of which is in the format of
+// /url/<encoded url>/alias/<encoded alias>, the alias is optional
+func (this *Mkzipper) parseIndex(indexData []byte) (zipFiles []ZipFile, err error) {
+	urlAliasPairs := make([]string, 0)
+	for _, line := range strings.Split(string(indexData), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		urlAliasPair := urlAliasRegx.FindString(line)
+		if urlAliasPair == "" || strings.Trim(line, "/") != urlAliasPair {
+			err = errors.New("invalid mkzip index file format")
+			return
+		}
+		urlAliasPairs = append(urlAliasPairs, urlAliasPair)
+	}
+	zipFiles, err = this.parseZipFiles(urlAliasPairs)
+	return
+}
+
+func (this *Mkzipper) parseZipFiles(urlAliasPairs []string) (zipFiles []ZipFile, err error) {
 	paliasMap := make(map[string]string, 0)
 	for _, urlAliasPair := range urlAliasPairs {
 		urlAliasItems := strings.Split(urlAliasPair, "/")
@@ -198,6 +247,36 @@ func (this *Mkzipper) Do(req ufop.UfopRequest, ufopBody io.ReadCloser) (result i
 		return
 	}
 
+	//read the url & alias list from the index file in url or request body
+	if len(zipFiles) == 0 {
+		src, srcErr := ufop.OpenSource(req, ufopBody)
+		if srcErr != nil {
+			err = fmt.Errorf("no mkzip resource url specified, %s", srcErr.Error())
+			return
+		}
+		defer src.Close()
+
+		indexData, readErr := ioutil.ReadAll(io.LimitReader(src.Body, MKZIP_MAX_INDEX_LENGTH+1))
+		if readErr != nil {
+			err = fmt.Errorf("read mkzip index file error, %s", readErr.Error())
+			return
+		}
+		if int64(len(indexData)) > MKZIP_MAX_INDEX_LENGTH {
+			err = errors.New("mkzip index file length exceeds the limit")
+			return
+		}
+
+		zipFiles, pErr = this.parseIndex(indexData)
+		if pErr != nil {
+			err = pErr
+			return
+		}
+		if len(zipFiles) == 0 {
+			err = errors.New("no mkzip resource url specified")
+			return
+		}
+	}
+
 	//check file count
 	if len(zipFiles) > this.maxFileCount {
 		err = errors.New("zip file count exceeds the limit")
@@ -208,40 +287,31 @@ func (this *Mkzipper) Do(req ufop.UfopRequest, ufopBody io.ReadCloser) (result i
 		return
 	}
 
-	//check whether file in bucket and exceeds the limit
-	statItems := make([]rs.EntryPath, 0)
-	statUrls := make([]string, 0)
-	for _, zipFile := range zipFiles {
-		entryPath := rs.EntryPath{
-			bucket, zipFile.key,
-		}
-		statItems = append(statItems, entryPath)
-		statUrls = append(statUrls, zipFile.url)
-	}
-
 	if !ignore404 {
-		//check files whether exist
-		qclient := rs.New(this.mac)
-		statRet, statErr := qclient.BatchStat(nil, statItems)
-		if statErr != nil {
-			if _, ok := statErr.(*rpc.ErrorInfo); !ok {
-				err = fmt.Errorf("batch stat error, %s", statErr.Error())
-				return
-			}
+		//check files whether exist in bucket
+		objStore, storeErr := store.New(&this.storeConfig, this.uptokenManager, bucket)
+		if storeErr != nil {
+			err = storeErr
+			return
 		}
 
-		for index := 0; index < len(statRet); index++ {
-			ret := statRet[index]
-			if ret.Code != 200 {
-				if ret.Code == 612 {
-					err = fmt.Errorf("batch stat '%s' error, no such file or directory", statUrls[index])
-				} else if ret.Code == 631 {
-					err = fmt.Errorf("batch stat '%s' error, no such bucket", statUrls[index])
-				} else {
-					err = fmt.Errorf("batch stat '%s' error, %d", statUrls[index], ret.Code)
-				}
-				return
+		statKeys := make([]string, 0, len(zipFiles))
+		for _, zipFile := range zipFiles {
+			statKeys = append(statKeys, zipFile.key)
+		}
+		_, statErrs := objStore.BatchStat(req.Job.Context(), statKeys)
+		for index, statErr := range statErrs {
+			if statErr == nil {
+				continue
 			}
+			if statErr == store.ErrNotFound {
+				err = fmt.Errorf("batch stat '%s' error, no such file or directory", zipFiles[index].url)
+			} else if v, ok := statErr.(*store.StoreError); ok && v.Code == 631 {
+				err = fmt.Errorf("batch stat '%s' error, no such bucket", zipFiles[index].url)
+			} else {
+				err = fmt.Errorf("batch stat '%s' error, %s", zipFiles[index].url, statErr.Error())
+			}
+			return
 		}
 	}
 
@@ -250,9 +320,20 @@ func (this *Mkzipper) Do(req ufop.UfopRequest, ufopBody io.ReadCloser) (result i
 	zipBuffer := new(bytes.Buffer)
 	zipWriter := zip.NewWriter(zipBuffer)
 
+	req.Job.SetPhase(ufop.JOB_PHASE_DOWNLOADING)
 	for _, zipFile := range zipFiles {
+		//stop when the job is cancelled
+		if jErr := req.Job.Err(); jErr != nil {
+			err = jErr
+			return
+		}
+
 		//read data and write
-		resResp, respErr := http.Get(zipFile.url)
+		var resResp *http.Response
+		resReq, respErr := http.NewRequest("GET", zipFile.url, nil)
+		if respErr == nil {
+			resResp, respErr = http.DefaultClient.Do(resReq.WithContext(req.Job.Context()))
+		}
 		if respErr != nil || resResp.StatusCode != http.StatusOK {
 			if respErr != nil {
 				err = errors.New("get zip file resource error, " + respErr.Error())
@@ -276,22 +357,24 @@ func (this *Mkzipper) Do(req ufop.UfopRequest, ufopBody io.ReadCloser) (result i
 			//convert encoding
 			fname := zipFile.alias
 			log.Infof("[%s] processing target file: %s", reqId, fname)
-			if encoding == "gbk" {
-				fname, tErr = utils.Utf82Gbk(fname)
-				if tErr != nil {
-					zErr = fmt.Errorf("unsupported encoding gbk, %s", tErr.Error())
-					return
-				}
+			fname, tErr = utils.EncodeString(encoding, fname)
+			if tErr != nil {
+				zErr = fmt.Errorf("unsupported encoding %s, %s", encoding, tErr.Error())
+				return
 			}
 
-			//create each zip file writer
-			fw, fErr := zipWriter.Create(fname)
+			//create each zip file writer, the utf8 flag is not set for other encodings
+			fw, fErr := zipWriter.CreateHeader(&zip.FileHeader{
+				Name:    fname,
+				Method:  zip.Deflate,
+				NonUTF8: encoding != utils.CHARSET_UTF8,
+			})
 			if fErr != nil {
 				zErr = fmt.Errorf("create zip file error, %s", fErr.Error())
 				return
 			}
 
-			respData, readErr := ioutil.ReadAll(resResp.Body)
+			respData, readErr := ioutil.ReadAll(req.Job.Reader(resResp.Body))
 			if readErr != nil {
 				zErr = fmt.Errorf("read zip file resource content error, %s", readErr.Error())
 				return
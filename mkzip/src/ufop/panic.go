@@ -0,0 +1,88 @@
+package ufop
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+
+	"github.com/qiniu/log"
+)
+
+const (
+	PANIC_ERROR_MESSAGE = "internal error"
+	PANIC_ERROR_TYPE    = "internal_error"
+)
+
+// UfopPanicError 表示处理请求时发生了 panic，Value 为 panic 的值，Stack 为发生 panic 时的调用栈
+type UfopPanicError struct {
+	ReqId string
+	Cmd   string
+	Value interface{}
+	Stack []byte
+}
+
+func (this *UfopPanicError) Error() string {
+	return fmt.Sprintf("%s, %v", PANIC_ERROR_MESSAGE, this.Value)
+}
+
+func newPanicError(ufopReq UfopRequest, value interface{}) *UfopPanicError {
+	return &UfopPanicError{
+		ReqId: ufopReq.ReqId,
+		Cmd:   ufopReq.Cmd,
+		Value: value,
+		Stack: debug.Stack(),
+	}
+}
+
+// log the panic with the stack, and write the crash report file when the crash report dir is configured
+func (this *UfopServer) reportPanic(panicErr *UfopPanicError, ufopReq UfopRequest) {
+	log.Errorf("[%s] panic when processing cmd '%s', %v\n%s", panicErr.ReqId, panicErr.Cmd, panicErr.Value,
+		panicErr.Stack)
+
+	if this.cfg.CrashReportDir == "" {
+		return
+	}
+	now := time.Now()
+	report := fmt.Sprintf("time: %s\nreqId: %s\ncmd: %s\nurl: %s\npanic: %v\n\n%s", now.Format(time.RFC3339),
+		panicErr.ReqId, panicErr.Cmd, ufopReq.Url, panicErr.Value, panicErr.Stack)
+	reportFile := filepath.Join(this.cfg.CrashReportDir, fmt.Sprintf("crash_%s_%d.log", panicErr.ReqId, now.Unix()))
+	if writeErr := ioutil.WriteFile(reportFile, []byte(report), 0644); writeErr != nil {
+		log.Errorf("[%s] write crash report failed, %s", panicErr.ReqId, writeErr.Error())
+	}
+}
+
+// call the job handler, the panic in the handler is recovered and returned as *UfopPanicError
+func doJob(jobHandler UfopJobHandler, ufopReq UfopRequest, ufopBody io.ReadCloser) (result interface{},
+	resultType int, contentType string, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = newPanicError(ufopReq, v)
+		}
+	}()
+	return jobHandler.Do(ufopReq, ufopBody)
+}
+
+// recover the panic when writing the response
+func (this *UfopServer) recoverServe(w http.ResponseWriter, ufopReq *UfopRequest) {
+	if v := recover(); v != nil {
+		panicErr := newPanicError(*ufopReq, v)
+		this.reportPanic(panicErr, *ufopReq)
+		writeJsonPanicError(w, panicErr)
+	}
+}
+
+func writeJsonPanicError(w http.ResponseWriter, panicErr *UfopPanicError) {
+	writeJsonResult(w, 500, struct {
+		Error string `json:"error"`
+		Type  string `json:"type"`
+		ReqId string `json:"reqId"`
+	}{
+		Error: PANIC_ERROR_MESSAGE,
+		Type:  PANIC_ERROR_TYPE,
+		ReqId: panicErr.ReqId,
+	})
+}
@@ -0,0 +1,262 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LocalStore 把文件保存在本地目录 <root>/<bucket>/<key> 中，hash 为和七牛存储一致的 etag
+type LocalStore struct {
+	bucketDir string
+}
+
+func NewLocalStore(root, bucket string) (objStore *LocalStore, err error) {
+	if bucket == "" || strings.ContainsAny(bucket, `/\`) || bucket == "." || bucket == ".." {
+		err = fmt.Errorf("invalid local store bucket '%s'", bucket)
+		return
+	}
+	objStore = &LocalStore{
+		bucketDir: filepath.Join(root, bucket),
+	}
+	return
+}
+
+func (this *LocalStore) path(key string) (localPath string, err error) {
+	localPath = filepath.Join(this.bucketDir, filepath.FromSlash(key))
+	if key == "" || !strings.HasPrefix(localPath, this.bucketDir+string(filepath.Separator)) {
+		err = fmt.Errorf("invalid local store key '%s'", key)
+	}
+	return
+}
+
+func (this *LocalStore) Put(ctx context.Context, key string, data io.Reader, size int64, extra *PutExtra) (
+	ret PutRet, err error) {
+	if extra == nil {
+		extra = &PutExtra{}
+	}
+	localPath, pErr := this.path(key)
+	if pErr != nil {
+		err = pErr
+		return
+	}
+	//fail early without writing the data, the existence is checked again when the file is linked
+	if !extra.Overwrite {
+		if _, statErr := os.Stat(localPath); statErr == nil {
+			err = ErrExists
+			return
+		}
+	}
+
+	if mkErr := os.MkdirAll(filepath.Dir(localPath), 0755); mkErr != nil {
+		err = fmt.Errorf("create local store dir failed, %s", mkErr.Error())
+		return
+	}
+
+	//write to a tmp file and then rename or link it, so that readers never see the partial file
+	tmpFp, openErr := ioutil.TempFile(filepath.Dir(localPath), ".ufop_tmp_")
+	if openErr != nil {
+		err = fmt.Errorf("open local store file failed, %s", openErr.Error())
+		return
+	}
+	defer os.Remove(tmpFp.Name())
+
+	hasher := NewEtagHasher()
+	_, cpErr := io.Copy(io.MultiWriter(tmpFp, hasher), data)
+	tmpFp.Close()
+	if cpErr != nil {
+		err = fmt.Errorf("write local store file failed, %s", cpErr.Error())
+		return
+	}
+
+	if err = replaceFile(tmpFp.Name(), localPath, extra.Overwrite); err != nil {
+		return
+	}
+
+	ret.Key = key
+	ret.Hash = hasher.Etag()
+	return
+}
+
+func (this *LocalStore) PutMultipart(ctx context.Context, key string, data io.ReaderAt, size int64,
+	extra *PutExtra) (PutRet, error) {
+	return this.Put(ctx, key, io.NewSectionReader(data, 0, size), size, extra)
+}
+
+func (this *LocalStore) Stat(ctx context.Context, key string) (info ObjectInfo, err error) {
+	localPath, pErr := this.path(key)
+	if pErr != nil {
+		err = pErr
+		return
+	}
+	return this.stat(key, localPath)
+}
+
+func (this *LocalStore) BatchStat(ctx context.Context, keys []string) (infos []ObjectInfo, errs []error) {
+	infos = make([]ObjectInfo, len(keys))
+	errs = make([]error, len(keys))
+	for index, key := range keys {
+		infos[index], errs[index] = this.Stat(ctx, key)
+	}
+	return
+}
+
+func (this *LocalStore) stat(key, localPath string) (info ObjectInfo, err error) {
+	localFp, openErr := os.Open(localPath)
+	if openErr != nil {
+		if os.IsNotExist(openErr) {
+			err = ErrNotFound
+		} else {
+			err = openErr
+		}
+		return
+	}
+	defer localFp.Close()
+
+	fileInfo, statErr := localFp.Stat()
+	if statErr != nil {
+		err = statErr
+		return
+	}
+	if fileInfo.IsDir() {
+		err = ErrNotFound
+		return
+	}
+
+	etag, hErr := Etag(localFp)
+	if hErr != nil {
+		err = hErr
+		return
+	}
+
+	info = ObjectInfo{
+		Key:      key,
+		Hash:     etag,
+		Fsize:    fileInfo.Size(),
+		PutTime:  fileInfo.ModTime().UnixNano() / 100,
+		MimeType: mime.TypeByExtension(filepath.Ext(key)),
+	}
+	return
+}
+
+func (this *LocalStore) List(prefix, marker string, limit int) (objects []ObjectInfo, nextMarker string, err error) {
+	keys := make([]string, 0)
+	walkErr := filepath.Walk(this.bucketDir, func(localPath string, fileInfo os.FileInfo, wErr error) error {
+		if wErr != nil {
+			if os.IsNotExist(wErr) {
+				return nil
+			}
+			return wErr
+		}
+		if fileInfo.IsDir() || strings.HasPrefix(fileInfo.Name(), ".ufop_tmp_") {
+			return nil
+		}
+		relPath, _ := filepath.Rel(this.bucketDir, localPath)
+		key := filepath.ToSlash(relPath)
+		if strings.HasPrefix(key, prefix) && key > marker {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if walkErr != nil {
+		err = fmt.Errorf("list local store failed, %s", walkErr.Error())
+		return
+	}
+
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+		nextMarker = keys[limit-1]
+	}
+
+	objects = make([]ObjectInfo, 0, len(keys))
+	for _, key := range keys {
+		info, sErr := this.stat(key, filepath.Join(this.bucketDir, filepath.FromSlash(key)))
+		if sErr != nil {
+			if sErr == ErrNotFound {
+				continue
+			}
+			err = sErr
+			return
+		}
+		objects = append(objects, info)
+	}
+	return
+}
+
+func (this *LocalStore) BatchMove(ctx context.Context, moves []MoveEntry, overwrite bool) (errs []error) {
+	errs = make([]error, len(moves))
+	for index, move := range moves {
+		errs[index] = this.move(move.SrcKey, move.DestKey, overwrite)
+	}
+	return
+}
+
+func (this *LocalStore) move(srcKey, destKey string, overwrite bool) (err error) {
+	srcPath, pErr := this.path(srcKey)
+	if pErr != nil {
+		err = pErr
+		return
+	}
+	destPath, pErr := this.path(destKey)
+	if pErr != nil {
+		err = pErr
+		return
+	}
+	if _, statErr := os.Stat(srcPath); statErr != nil {
+		err = ErrNotFound
+		return
+	}
+
+	if mkErr := os.MkdirAll(filepath.Dir(destPath), 0755); mkErr != nil {
+		err = fmt.Errorf("create local store dir failed, %s", mkErr.Error())
+		return
+	}
+	err = replaceFile(srcPath, destPath, overwrite)
+	return
+}
+
+// move the file to the dest path, the existing file is replaced by rename when overwritten, otherwise the file
+// is hard linked to the dest path which fails atomically when the dest path exists, and then the src is removed
+func replaceFile(srcPath, destPath string, overwrite bool) (err error) {
+	if overwrite {
+		if rnErr := os.Rename(srcPath, destPath); rnErr != nil {
+			err = fmt.Errorf("rename local store file failed, %s", rnErr.Error())
+		}
+		return
+	}
+
+	if lnErr := os.Link(srcPath, destPath); lnErr != nil {
+		if os.IsExist(lnErr) {
+			err = ErrExists
+		} else {
+			err = fmt.Errorf("link local store file failed, %s", lnErr.Error())
+		}
+		return
+	}
+	os.Remove(srcPath)
+	return
+}
+
+func (this *LocalStore) Delete(key string) (err error) {
+	localPath, pErr := this.path(key)
+	if pErr != nil {
+		err = pErr
+		return
+	}
+	rmErr := os.Remove(localPath)
+	if rmErr != nil {
+		if os.IsNotExist(rmErr) {
+			err = ErrNotFound
+		} else {
+			err = rmErr
+		}
+	}
+	return
+}
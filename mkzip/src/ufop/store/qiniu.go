@@ -0,0 +1,547 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qiniu/api.v6/auth/digest"
+	"github.com/qiniu/api.v6/conf"
+	"github.com/qiniu/api.v6/rs"
+	"github.com/qiniu/api.v6/rsf"
+	"github.com/qiniu/log"
+	"github.com/qiniu/rpc"
+)
+
+const (
+	QINIU_BLOCK_SIZE         = 4 * 1024 * 1024 //4MB
+	QINIU_BLOCK_EXPIRE_AHEAD = 3600            //1 hour
+	QINIU_PUT_WORKERS        = 8
+	//the prefix of the custom metadata, the metadata is returned as the response header when downloaded
+	QINIU_META_PREFIX = "x-qn-meta-"
+	//the max operations in one batch request
+	QINIU_BATCH_LIMIT = 1000
+	//the status of the batch request when some operations fail
+	QINIU_BATCH_PARTIAL_FAILED = 298
+)
+
+// QiniuStore 上传文件时使用的上传域名按照空间解析，并保存在实例中，多个上传域名之间自动切换
+type QiniuStore struct {
+	cfg    *StoreConfig
+	mac    *digest.Mac
+	tokens *UptokenManager
+	bucket string
+	client *http.Client
+
+	upHostsOnce sync.Once
+	upHosts     []string
+	upHostsErr  error
+}
+
+type qiniuPutRet struct {
+	Key   string `json:"key"`
+	Hash  string `json:"hash"`
+	Error string `json:"error"`
+}
+
+type qiniuBlkputRet struct {
+	Ctx       string `json:"ctx"`
+	Crc32     uint32 `json:"crc32"`
+	ExpiredAt int64  `json:"expired_at"`
+	Error     string `json:"error,omitempty"`
+}
+
+// qiniuPutProgress 为分块上传的进度，保存在进度文件中，上传失败后再次上传时跳过已经上传的块
+type qiniuPutProgress struct {
+	Fsize  int64            `json:"fsize"`
+	Blocks []qiniuBlkputRet `json:"blocks"`
+}
+
+func loadQiniuPutProgress(progressFile string, size int64, blockCount int) (progress *qiniuPutProgress) {
+	progress = &qiniuPutProgress{
+		Fsize:  size,
+		Blocks: make([]qiniuBlkputRet, blockCount),
+	}
+	if progressFile == "" {
+		return
+	}
+	progressData, readErr := ioutil.ReadFile(progressFile)
+	if readErr != nil {
+		return
+	}
+
+	var lastProgress qiniuPutProgress
+	if decodeErr := json.Unmarshal(progressData, &lastProgress); decodeErr != nil {
+		log.Warnf("invalid put progress file %s, %s", progressFile, decodeErr.Error())
+		return
+	}
+	if lastProgress.Fsize != size || len(lastProgress.Blocks) != blockCount {
+		return
+	}
+	//skip the blocks which are about to expire
+	expiredAt := time.Now().Add(QINIU_BLOCK_EXPIRE_AHEAD * time.Second).Unix()
+	for blkIdx, blkputRet := range lastProgress.Blocks {
+		if blkputRet.Ctx != "" && blkputRet.ExpiredAt > expiredAt {
+			progress.Blocks[blkIdx] = blkputRet
+		}
+	}
+	return
+}
+
+func (this *qiniuPutProgress) save(progressFile string) {
+	if progressFile == "" {
+		return
+	}
+	progressData, _ := json.Marshal(this)
+	if writeErr := ioutil.WriteFile(progressFile, progressData, 0644); writeErr != nil {
+		log.Warnf("write put progress file %s failed, %s", progressFile, writeErr.Error())
+	}
+}
+
+func NewQiniuStore(cfg *StoreConfig, tokens *UptokenManager, bucket string) *QiniuStore {
+	return &QiniuStore{
+		cfg:    cfg,
+		mac:    tokens.Mac(),
+		tokens: tokens,
+		bucket: bucket,
+		client: newStoreClient(cfg),
+	}
+}
+
+func (this *QiniuStore) resolveUpHosts() ([]string, error) {
+	this.upHostsOnce.Do(func() {
+		this.upHosts, this.upHostsErr = resolveQiniuUpHosts(this.cfg, this.mac.AccessKey, this.bucket)
+	})
+	return this.upHosts, this.upHostsErr
+}
+
+// call the upload function with each up host in order, until it succeeds or fails with an error not caused by the host
+func (this *QiniuStore) withUpHosts(ctx context.Context, upload func(upHost string) error) (err error) {
+	upHosts, hErr := this.resolveUpHosts()
+	if hErr != nil {
+		err = hErr
+		return
+	}
+	for index, upHost := range upHosts {
+		err = upload(upHost)
+		if err == nil || !isUpHostError(err) || ctx.Err() != nil {
+			return
+		}
+		if index < len(upHosts)-1 {
+			log.Warnf("upload to %s failed, try next up host, %s", upHost, err.Error())
+		}
+	}
+	return
+}
+
+func (this *QiniuStore) Put(ctx context.Context, key string, data io.Reader, size int64, extra *PutExtra) (
+	ret PutRet, err error) {
+	if extra == nil {
+		extra = &PutExtra{}
+	}
+	uptoken, tErr := this.tokens.Uptoken(this.bucket, key, extra.Overwrite)
+	if tErr != nil {
+		err = tErr
+		return
+	}
+	mimeType := extra.MimeType
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+
+	//build the multipart form, the data is kept in memory so that it can be sent to another up host
+	var formData bytes.Buffer
+	formWriter := multipart.NewWriter(&formData)
+	formWriter.WriteField("token", uptoken)
+	formWriter.WriteField("key", key)
+	for name, value := range extra.Headers {
+		formWriter.WriteField(QINIU_META_PREFIX+name, value)
+	}
+	fileHeader := textproto.MIMEHeader{}
+	fileHeader.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`,
+		strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(key)))
+	fileHeader.Set("Content-Type", mimeType)
+	fileWriter, _ := formWriter.CreatePart(fileHeader)
+	if _, cpErr := io.Copy(fileWriter, data); cpErr != nil {
+		err = fmt.Errorf("read put data failed, %s", cpErr.Error())
+		return
+	}
+	formWriter.Close()
+
+	var putRet qiniuPutRet
+	err = this.withUpHosts(ctx, func(upHost string) error {
+		req, reqErr := http.NewRequest("POST", upHost+"/", bytes.NewReader(formData.Bytes()))
+		if reqErr != nil {
+			return reqErr
+		}
+		req.Header.Set("Content-Type", formWriter.FormDataContentType())
+		return this.call(ctx, req, &putRet)
+	})
+	if err != nil {
+		return
+	}
+	ret.Key = key
+	ret.Hash = putRet.Hash
+	return
+}
+
+func (this *QiniuStore) PutMultipart(ctx context.Context, key string, data io.ReaderAt, size int64,
+	extra *PutExtra) (ret PutRet, err error) {
+	if extra == nil {
+		extra = &PutExtra{}
+	}
+	if size <= 0 {
+		return this.Put(ctx, key, io.NewSectionReader(data, 0, size), size, extra)
+	}
+	uptoken, tErr := this.tokens.Uptoken(this.bucket, key, extra.Overwrite)
+	if tErr != nil {
+		err = tErr
+		return
+	}
+
+	//load the progress of the last put, the uploaded blocks are skipped
+	blockCount := int((size + QINIU_BLOCK_SIZE - 1) / QINIU_BLOCK_SIZE)
+	progress := loadQiniuPutProgress(extra.ProgressFile, size, blockCount)
+	var progressLock sync.Mutex
+
+	//make blocks
+	blockErrs := make([]error, blockCount)
+	workers := make(chan struct{}, QINIU_PUT_WORKERS)
+	var wg sync.WaitGroup
+	for blkIdx := 0; blkIdx < blockCount; blkIdx++ {
+		if progress.Blocks[blkIdx].Ctx != "" {
+			continue
+		}
+		//stop making the left blocks when cancelled
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			blockErrs[blkIdx] = ctxErr
+			break
+		}
+		offset := int64(blkIdx) * QINIU_BLOCK_SIZE
+		blkSize := size - offset
+		if blkSize > QINIU_BLOCK_SIZE {
+			blkSize = QINIU_BLOCK_SIZE
+		}
+
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(blkIdx int, offset, blkSize int64) {
+			defer func() {
+				//the panic in the background can not be recovered by the caller, so it fails the block
+				if v := recover(); v != nil {
+					blockErrs[blkIdx] = fmt.Errorf("make block %d panic, %v", blkIdx, v)
+				}
+				<-workers
+				wg.Done()
+			}()
+			blkputRet, blkErr := this.mkblk(ctx, uptoken, data, offset, blkSize)
+			if blkErr != nil {
+				blockErrs[blkIdx] = blkErr
+				return
+			}
+			progressLock.Lock()
+			defer progressLock.Unlock()
+			progress.Blocks[blkIdx] = blkputRet
+			progress.save(extra.ProgressFile)
+		}(blkIdx, offset, blkSize)
+	}
+	wg.Wait()
+	for _, blkErr := range blockErrs {
+		if blkErr != nil {
+			err = blkErr
+			return
+		}
+	}
+	blockCtxs := make([]string, 0, blockCount)
+	for _, blkputRet := range progress.Blocks {
+		blockCtxs = append(blockCtxs, blkputRet.Ctx)
+	}
+
+	//make file
+	mkfilePath := fmt.Sprintf("/mkfile/%d/key/%s", size, base64.URLEncoding.EncodeToString([]byte(key)))
+	if extra.MimeType != "" {
+		mkfilePath += "/mimeType/" + base64.URLEncoding.EncodeToString([]byte(extra.MimeType))
+	}
+	for name, value := range extra.Headers {
+		mkfilePath += "/" + QINIU_META_PREFIX + name + "/" + base64.URLEncoding.EncodeToString([]byte(value))
+	}
+	mkfileBody := strings.Join(blockCtxs, ",")
+
+	var putRet qiniuPutRet
+	err = this.withUpHosts(ctx, func(upHost string) error {
+		req, reqErr := http.NewRequest("POST", upHost+mkfilePath, strings.NewReader(mkfileBody))
+		if reqErr != nil {
+			return reqErr
+		}
+		req.Header.Set("Content-Type", "text/plain")
+		req.Header.Set("Authorization", "UpToken "+uptoken)
+		return this.call(ctx, req, &putRet)
+	})
+	if err != nil {
+		return
+	}
+	if extra.ProgressFile != "" {
+		os.Remove(extra.ProgressFile)
+	}
+	ret.Key = key
+	ret.Hash = putRet.Hash
+	return
+}
+
+// upload the whole block in one chunk, and check the crc32 of the block
+func (this *QiniuStore) mkblk(ctx context.Context, uptoken string, data io.ReaderAt, offset, blkSize int64) (
+	blkputRet qiniuBlkputRet, err error) {
+	var blkCrc32 uint32
+	err = this.withUpHosts(ctx, func(upHost string) error {
+		crc32Hash := crc32.NewIEEE()
+		blkReader := io.TeeReader(io.NewSectionReader(data, offset, blkSize), crc32Hash)
+		req, reqErr := http.NewRequest("POST", fmt.Sprintf("%s/mkblk/%d", upHost, blkSize), blkReader)
+		if reqErr != nil {
+			return reqErr
+		}
+		req.ContentLength = blkSize
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Authorization", "UpToken "+uptoken)
+		callErr := this.call(ctx, req, &blkputRet)
+		blkCrc32 = crc32Hash.Sum32()
+		return callErr
+	})
+	if err != nil {
+		return
+	}
+	if blkputRet.Crc32 != blkCrc32 {
+		err = &StoreError{
+			Code:    http.StatusInternalServerError,
+			Message: "block crc32 mismatch",
+		}
+	}
+	return
+}
+
+// send the request and decode the json response, the partial failure of the batch request (298) is decoded as
+// the response too
+func (this *QiniuStore) call(ctx context.Context, req *http.Request, ret interface{}) (err error) {
+	resp, respErr := this.client.Do(req.WithContext(ctx))
+	if respErr != nil {
+		err = respErr
+		return
+	}
+	defer resp.Body.Close()
+
+	respData, readErr := ioutil.ReadAll(resp.Body)
+	if readErr != nil {
+		err = readErr
+		return
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != QINIU_BATCH_PARTIAL_FAILED {
+		var errRet qiniuPutRet
+		json.Unmarshal(respData, &errRet)
+		if errRet.Error == "" {
+			errRet.Error = resp.Status
+		}
+		err = qiniuError(&rpc.ErrorInfo{
+			Code: resp.StatusCode,
+			Err:  errRet.Error,
+		})
+		return
+	}
+	if decodeErr := json.Unmarshal(respData, ret); decodeErr != nil {
+		err = fmt.Errorf("parse qiniu response failed, %s", decodeErr.Error())
+	}
+	return
+}
+
+// build the rs request signed by the access key, the rs package does not support the context
+func (this *QiniuStore) rsRequest(path, body string) (req *http.Request, err error) {
+	req, err = http.NewRequest("POST", conf.RS_HOST+path, strings.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "QBox "+this.mac.Sign([]byte(path+"\n"+body)))
+	return
+}
+
+func (this *QiniuStore) Stat(ctx context.Context, key string) (info ObjectInfo, err error) {
+	req, reqErr := this.rsRequest("/stat/"+base64.URLEncoding.EncodeToString([]byte(this.bucket+":"+key)), "")
+	if reqErr != nil {
+		err = reqErr
+		return
+	}
+	var entry rs.Entry
+	if sErr := this.call(ctx, req, &entry); sErr != nil {
+		err = sErr
+		return
+	}
+	info = ObjectInfo{
+		Key:      key,
+		Hash:     entry.Hash,
+		Fsize:    entry.Fsize,
+		PutTime:  entry.PutTime,
+		MimeType: entry.MimeType,
+	}
+	return
+}
+
+func (this *QiniuStore) BatchStat(ctx context.Context, keys []string) (infos []ObjectInfo, errs []error) {
+	infos = make([]ObjectInfo, len(keys))
+	errs = make([]error, len(keys))
+	for start := 0; start < len(keys); start += QINIU_BATCH_LIMIT {
+		end := start + QINIU_BATCH_LIMIT
+		if end > len(keys) {
+			end = len(keys)
+		}
+		ops := make([]string, 0, end-start)
+		for _, key := range keys[start:end] {
+			ops = append(ops, "/stat/"+base64.URLEncoding.EncodeToString([]byte(this.bucket+":"+key)))
+		}
+
+		var batchRets []rs.BatchStatItemRet
+		if bErr := this.batch(ctx, ops, &batchRets); bErr != nil {
+			for index := start; index < end; index++ {
+				errs[index] = bErr
+			}
+			continue
+		}
+		for index := start; index < end; index++ {
+			if index-start >= len(batchRets) {
+				errs[index] = errors.New("no batch stat result")
+			} else if batchRet := batchRets[index-start]; batchRet.Code != 200 {
+				errs[index] = qiniuError(&rpc.ErrorInfo{
+					Code: batchRet.Code,
+					Err:  batchRet.Error,
+				})
+			} else {
+				infos[index] = ObjectInfo{
+					Key:      keys[index],
+					Hash:     batchRet.Data.Hash,
+					Fsize:    batchRet.Data.Fsize,
+					PutTime:  batchRet.Data.PutTime,
+					MimeType: batchRet.Data.MimeType,
+				}
+			}
+		}
+	}
+	return
+}
+
+func (this *QiniuStore) List(prefix, marker string, limit int) (objects []ObjectInfo, nextMarker string, err error) {
+	items, lMarker, lErr := rsf.New(this.mac).ListPrefix(nil, this.bucket, prefix, marker, limit)
+	if lErr != nil && lErr != io.EOF {
+		err = qiniuError(lErr)
+		return
+	}
+	objects = make([]ObjectInfo, 0, len(items))
+	for _, item := range items {
+		objects = append(objects, ObjectInfo{
+			Key:      item.Key,
+			Hash:     item.Hash,
+			Fsize:    item.Fsize,
+			PutTime:  item.PutTime,
+			MimeType: item.MimeType,
+		})
+	}
+	if lErr != io.EOF {
+		nextMarker = lMarker
+	}
+	return
+}
+
+func (this *QiniuStore) Delete(key string) (err error) {
+	dErr := rs.New(this.mac).Delete(nil, this.bucket, key)
+	if dErr != nil {
+		err = qiniuError(dErr)
+	}
+	return
+}
+
+func (this *QiniuStore) BatchMove(ctx context.Context, moves []MoveEntry, overwrite bool) (errs []error) {
+	errs = make([]error, len(moves))
+	for start := 0; start < len(moves); start += QINIU_BATCH_LIMIT {
+		end := start + QINIU_BATCH_LIMIT
+		if end > len(moves) {
+			end = len(moves)
+		}
+		ops := make([]string, 0, end-start)
+		for _, move := range moves[start:end] {
+			op := rs.URIMove(this.bucket, move.SrcKey, this.bucket, move.DestKey)
+			if overwrite {
+				op += "/force/true"
+			}
+			ops = append(ops, op)
+		}
+
+		var batchRets []rs.BatchItemRet
+		bErr := this.batch(ctx, ops, &batchRets)
+		if bErr != nil {
+			for index := start; index < end; index++ {
+				errs[index] = bErr
+			}
+			continue
+		}
+		for index := start; index < end; index++ {
+			if index-start >= len(batchRets) {
+				errs[index] = errors.New("no batch move result")
+			} else if batchRet := batchRets[index-start]; batchRet.Code != 200 {
+				errs[index] = qiniuError(&rpc.ErrorInfo{
+					Code: batchRet.Code,
+					Err:  batchRet.Error,
+				})
+			}
+		}
+	}
+	return
+}
+
+// send the batch operations, the result of each operation is decoded into the rets in order
+func (this *QiniuStore) batch(ctx context.Context, ops []string, rets interface{}) (err error) {
+	req, reqErr := this.rsRequest("/batch", url.Values{"op": ops}.Encode())
+	if reqErr != nil {
+		err = reqErr
+		return
+	}
+	err = this.call(ctx, req, rets)
+	return
+}
+
+func qiniuError(err error) error {
+	if v, ok := err.(*rpc.ErrorInfo); ok {
+		switch v.Code {
+		case 612:
+			return ErrNotFound
+		case 614:
+			return ErrExists
+		default:
+			return &StoreError{
+				Code:    v.Code,
+				Message: v.Err,
+			}
+		}
+	}
+	return err
+}
+
+// the network errors and the server errors except the callback failure are caused by the up host
+func isUpHostError(err error) bool {
+	switch v := err.(type) {
+	case *url.Error:
+		return true
+	case *StoreError:
+		return v.Code/100 == 5 && v.Code != 579
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	QINIU_UC_HOST          = "https://uc.qbox.me"
+	QINIU_REGION_CACHE_TTL = 24 * 3600 //24 hours
+)
+
+// QiniuRegion 为七牛存储区域的上传域名，Acc 为加速上传域名，Src 为源站上传域名
+type QiniuRegion struct {
+	Acc []string
+	Src []string
+}
+
+var QiniuRegions = map[string]QiniuRegion{
+	"z0": {
+		Acc: []string{"upload.qiniup.com"},
+		Src: []string{"up.qiniup.com"},
+	},
+	"z1": {
+		Acc: []string{"upload-z1.qiniup.com"},
+		Src: []string{"up-z1.qiniup.com"},
+	},
+	"z2": {
+		Acc: []string{"upload-z2.qiniup.com"},
+		Src: []string{"up-z2.qiniup.com"},
+	},
+	"na0": {
+		Acc: []string{"upload-na0.qiniup.com"},
+		Src: []string{"up-na0.qiniup.com"},
+	},
+	"as0": {
+		Acc: []string{"upload-as0.qiniup.com"},
+		Src: []string{"up-as0.qiniup.com"},
+	},
+}
+
+type qiniuRegionQueryRet struct {
+	Ttl int64 `json:"ttl"`
+	Up  struct {
+		Acc struct {
+			Main   []string `json:"main"`
+			Backup []string `json:"backup"`
+		} `json:"acc"`
+		Src struct {
+			Main   []string `json:"main"`
+			Backup []string `json:"backup"`
+		} `json:"src"`
+	} `json:"up"`
+}
+
+type qiniuRegionCacheItem struct {
+	region   QiniuRegion
+	deadline time.Time
+}
+
+var qiniuRegionCache = struct {
+	sync.Mutex
+	items map[string]qiniuRegionCacheItem
+}{
+	items: make(map[string]qiniuRegionCacheItem),
+}
+
+// resolve the up hosts of the bucket, the hosts configured for the bucket take precedence over the global hosts,
+// then the hosts of the configured region, and at last the hosts of the region queried from uc
+func resolveQiniuUpHosts(cfg *StoreConfig, accessKey, bucket string) (upHosts []string, err error) {
+	hosts := cfg.QiniuBucketUpHosts[bucket]
+	if len(hosts) == 0 {
+		hosts = cfg.QiniuUpHosts
+	}
+
+	if len(hosts) == 0 {
+		var region QiniuRegion
+		if cfg.QiniuRegion != "" {
+			var ok bool
+			if region, ok = QiniuRegions[cfg.QiniuRegion]; !ok {
+				err = fmt.Errorf("unknown qiniu region '%s'", cfg.QiniuRegion)
+				return
+			}
+		} else {
+			region, err = queryQiniuRegion(cfg.QiniuUcHost, accessKey, bucket)
+			if err != nil {
+				return
+			}
+		}
+
+		if cfg.QiniuUseAcc {
+			hosts = append(append(hosts, region.Acc...), region.Src...)
+		} else {
+			hosts = append(append(hosts, region.Src...), region.Acc...)
+		}
+	}
+
+	scheme := "http://"
+	if cfg.QiniuUseHttps {
+		scheme = "https://"
+	}
+	for _, host := range hosts {
+		if !strings.HasPrefix(host, "http://") && !strings.HasPrefix(host, "https://") {
+			host = scheme + host
+		}
+		upHosts = append(upHosts, strings.TrimSuffix(host, "/"))
+	}
+	if len(upHosts) == 0 {
+		err = fmt.Errorf("no up host found for bucket '%s'", bucket)
+	}
+	return
+}
+
+func queryQiniuRegion(ucHost, accessKey, bucket string) (region QiniuRegion, err error) {
+	if ucHost == "" {
+		ucHost = QINIU_UC_HOST
+	}
+	cacheKey := accessKey + ":" + bucket
+
+	qiniuRegionCache.Lock()
+	cacheItem, ok := qiniuRegionCache.items[cacheKey]
+	qiniuRegionCache.Unlock()
+	if ok && time.Now().Before(cacheItem.deadline) {
+		region = cacheItem.region
+		return
+	}
+
+	queryUrl := fmt.Sprintf("%s/v2/query?ak=%s&bucket=%s", strings.TrimSuffix(ucHost, "/"),
+		url.QueryEscape(accessKey), url.QueryEscape(bucket))
+	resp, respErr := http.Get(queryUrl)
+	if respErr != nil {
+		err = fmt.Errorf("query bucket region failed, %s", respErr.Error())
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("query bucket region failed, %s", resp.Status)
+		return
+	}
+
+	var queryRet qiniuRegionQueryRet
+	if decodeErr := json.NewDecoder(resp.Body).Decode(&queryRet); decodeErr != nil {
+		err = fmt.Errorf("parse bucket region failed, %s", decodeErr.Error())
+		return
+	}
+	region.Acc = append(queryRet.Up.Acc.Main, queryRet.Up.Acc.Backup...)
+	region.Src = append(queryRet.Up.Src.Main, queryRet.Up.Src.Backup...)
+	if len(region.Acc) == 0 && len(region.Src) == 0 {
+		err = fmt.Errorf("no up host found for bucket '%s'", bucket)
+		return
+	}
+
+	ttl := queryRet.Ttl
+	if ttl <= 0 {
+		ttl = QINIU_REGION_CACHE_TTL
+	}
+	qiniuRegionCache.Lock()
+	qiniuRegionCache.items[cacheKey] = qiniuRegionCacheItem{
+		region:   region,
+		deadline: time.Now().Add(time.Duration(ttl) * time.Second),
+	}
+	qiniuRegionCache.Unlock()
+	return
+}
@@ -0,0 +1,511 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	S3_DEFAULT_REGION   = "us-east-1"
+	S3_PART_SIZE        = 8 * 1024 * 1024 //8MB
+	S3_UNSIGNED_PAYLOAD = "UNSIGNED-PAYLOAD"
+	S3_META_PREFIX      = "x-amz-meta-"
+)
+
+// S3Store 使用 AWS Signature V4 访问兼容 S3 协议的对象存储，hash 为对象的 ETag
+type S3Store struct {
+	endpoint  *url.URL
+	region    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	bucket    string
+	client    *http.Client
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadId string `xml:"UploadId"`
+}
+
+type s3CompletePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name         `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletePart `xml:"Part"`
+}
+
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key          string `xml:"Key"`
+		ETag         string `xml:"ETag"`
+		Size         int64  `xml:"Size"`
+		LastModified string `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func NewS3Store(cfg *StoreConfig, bucket string) *S3Store {
+	endpoint, _ := url.Parse(cfg.S3Endpoint)
+	region := cfg.S3Region
+	if region == "" {
+		region = S3_DEFAULT_REGION
+	}
+	return &S3Store{
+		endpoint:  endpoint,
+		region:    region,
+		accessKey: cfg.S3AccessKey,
+		secretKey: cfg.S3SecretKey,
+		pathStyle: cfg.S3PathStyle,
+		bucket:    bucket,
+		client:    newStoreClient(cfg),
+	}
+}
+
+func (this *S3Store) Put(ctx context.Context, key string, data io.Reader, size int64, extra *PutExtra) (
+	ret PutRet, err error) {
+	if extra == nil {
+		extra = &PutExtra{}
+	}
+	//fail early without sending the data, the existence is checked again by the put
+	if !extra.Overwrite {
+		if err = this.checkNotExists(ctx, key); err != nil {
+			return
+		}
+	}
+
+	header := s3PutHeader(extra)
+	if !extra.Overwrite {
+		header.Set("If-None-Match", "*")
+	}
+	resp, respErr := this.do(ctx, "PUT", key, nil, header, data, size)
+	if respErr != nil {
+		err = respErr
+		return
+	}
+	resp.Body.Close()
+
+	ret.Key = key
+	ret.Hash = strings.Trim(resp.Header.Get("ETag"), `"`)
+	return
+}
+
+func (this *S3Store) PutMultipart(ctx context.Context, key string, data io.ReaderAt, size int64, extra *PutExtra) (
+	ret PutRet, err error) {
+	if extra == nil {
+		extra = &PutExtra{}
+	}
+	if size <= S3_PART_SIZE {
+		return this.Put(ctx, key, io.NewSectionReader(data, 0, size), size, extra)
+	}
+	//fail early without uploading the parts, the existence is checked again when the upload is completed
+	if !extra.Overwrite {
+		if err = this.checkNotExists(ctx, key); err != nil {
+			return
+		}
+	}
+
+	//initiate
+	header := s3PutHeader(extra)
+	resp, respErr := this.do(ctx, "POST", key, url.Values{"uploads": {""}}, header, nil, 0)
+	if respErr != nil {
+		err = respErr
+		return
+	}
+	var initResult s3InitiateMultipartUploadResult
+	decodeErr := xml.NewDecoder(resp.Body).Decode(&initResult)
+	resp.Body.Close()
+	if decodeErr != nil {
+		err = fmt.Errorf("parse s3 initiate multipart upload result failed, %s", decodeErr.Error())
+		return
+	}
+	uploadId := initResult.UploadId
+
+	//upload parts
+	var complete s3CompleteMultipartUpload
+	for offset, partNumber := int64(0), 1; offset < size; offset, partNumber = offset+S3_PART_SIZE, partNumber+1 {
+		partSize := size - offset
+		if partSize > S3_PART_SIZE {
+			partSize = S3_PART_SIZE
+		}
+		params := url.Values{
+			"partNumber": {strconv.Itoa(partNumber)},
+			"uploadId":   {uploadId},
+		}
+		resp, respErr = this.do(ctx, "PUT", key, params, nil, io.NewSectionReader(data, offset, partSize), partSize)
+		if respErr != nil {
+			err = respErr
+			this.abortMultipart(key, uploadId)
+			return
+		}
+		resp.Body.Close()
+		complete.Parts = append(complete.Parts, s3CompletePart{
+			PartNumber: partNumber,
+			ETag:       resp.Header.Get("ETag"),
+		})
+	}
+
+	//complete
+	completeData, _ := xml.Marshal(&complete)
+	completeHeader := http.Header{}
+	if !extra.Overwrite {
+		completeHeader.Set("If-None-Match", "*")
+	}
+	resp, respErr = this.do(ctx, "POST", key, url.Values{"uploadId": {uploadId}}, completeHeader,
+		bytes.NewReader(completeData), int64(len(completeData)))
+	if respErr != nil {
+		err = respErr
+		this.abortMultipart(key, uploadId)
+		return
+	}
+	//the complete request may fail with status 200 and an error in the body
+	respData, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	var completeErr s3Error
+	if xml.Unmarshal(respData, &completeErr) == nil && completeErr.Code != "" {
+		if completeErr.Code == "PreconditionFailed" {
+			err = ErrExists
+		} else {
+			err = &StoreError{
+				Code:    http.StatusInternalServerError,
+				Message: completeErr.Code + ": " + completeErr.Message,
+			}
+		}
+		this.abortMultipart(key, uploadId)
+		return
+	}
+
+	info, statErr := this.Stat(ctx, key)
+	if statErr != nil {
+		err = statErr
+		return
+	}
+	ret.Key = key
+	ret.Hash = info.Hash
+	return
+}
+
+// abort the multipart upload to free the uploaded parts, it is not cancelled with the put
+func (this *S3Store) abortMultipart(key, uploadId string) {
+	resp, respErr := this.do(context.Background(), "DELETE", key, url.Values{"uploadId": {uploadId}}, nil, nil, 0)
+	if respErr == nil {
+		resp.Body.Close()
+	}
+}
+
+func (this *S3Store) checkNotExists(ctx context.Context, key string) (err error) {
+	_, statErr := this.Stat(ctx, key)
+	if statErr == nil {
+		err = ErrExists
+	} else if statErr != ErrNotFound {
+		err = statErr
+	}
+	return
+}
+
+func (this *S3Store) Stat(ctx context.Context, key string) (info ObjectInfo, err error) {
+	resp, respErr := this.do(ctx, "HEAD", key, nil, nil, nil, 0)
+	if respErr != nil {
+		err = respErr
+		return
+	}
+	resp.Body.Close()
+
+	info = ObjectInfo{
+		Key:      key,
+		Hash:     strings.Trim(resp.Header.Get("ETag"), `"`),
+		Fsize:    resp.ContentLength,
+		MimeType: resp.Header.Get("Content-Type"),
+	}
+	if lastModified, tErr := http.ParseTime(resp.Header.Get("Last-Modified")); tErr == nil {
+		info.PutTime = lastModified.UnixNano() / 100
+	}
+	return
+}
+
+// s3 has no batch stat operation, so the objects are stated one by one
+func (this *S3Store) BatchStat(ctx context.Context, keys []string) (infos []ObjectInfo, errs []error) {
+	infos = make([]ObjectInfo, len(keys))
+	errs = make([]error, len(keys))
+	for index, key := range keys {
+		infos[index], errs[index] = this.Stat(ctx, key)
+	}
+	return
+}
+
+func (this *S3Store) List(prefix, marker string, limit int) (objects []ObjectInfo, nextMarker string, err error) {
+	params := url.Values{
+		"list-type": {"2"},
+		"prefix":    {prefix},
+	}
+	if marker != "" {
+		params.Set("continuation-token", marker)
+	}
+	if limit > 0 {
+		params.Set("max-keys", strconv.Itoa(limit))
+	}
+	resp, respErr := this.do(context.Background(), "GET", "", params, nil, nil, 0)
+	if respErr != nil {
+		err = respErr
+		return
+	}
+	defer resp.Body.Close()
+
+	var listResult s3ListBucketResult
+	if decodeErr := xml.NewDecoder(resp.Body).Decode(&listResult); decodeErr != nil {
+		err = fmt.Errorf("parse s3 list result failed, %s", decodeErr.Error())
+		return
+	}
+
+	objects = make([]ObjectInfo, 0, len(listResult.Contents))
+	for _, content := range listResult.Contents {
+		info := ObjectInfo{
+			Key:   content.Key,
+			Hash:  strings.Trim(content.ETag, `"`),
+			Fsize: content.Size,
+		}
+		if lastModified, tErr := time.Parse(time.RFC3339, content.LastModified); tErr == nil {
+			info.PutTime = lastModified.UnixNano() / 100
+		}
+		objects = append(objects, info)
+	}
+	if listResult.IsTruncated {
+		nextMarker = listResult.NextContinuationToken
+	}
+	return
+}
+
+func (this *S3Store) Delete(key string) (err error) {
+	//s3 returns 204 even if the key does not exist
+	if _, err = this.Stat(context.Background(), key); err != nil {
+		return
+	}
+	resp, respErr := this.do(context.Background(), "DELETE", key, nil, nil, nil, 0)
+	if respErr != nil {
+		err = respErr
+		return
+	}
+	resp.Body.Close()
+	return
+}
+
+// s3 has no move operation, so the object is copied and then the source is deleted
+func (this *S3Store) BatchMove(ctx context.Context, moves []MoveEntry, overwrite bool) (errs []error) {
+	errs = make([]error, len(moves))
+	for index, move := range moves {
+		errs[index] = this.move(ctx, move.SrcKey, move.DestKey, overwrite)
+	}
+	return
+}
+
+func (this *S3Store) move(ctx context.Context, srcKey, destKey string, overwrite bool) (err error) {
+	//the check may race with another put, so the copy is conditional too, the check still works for the
+	//servers not supporting the conditional copy
+	if !overwrite {
+		if err = this.checkNotExists(ctx, destKey); err != nil {
+			return
+		}
+	}
+
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", "/"+this.bucket+"/"+s3Escape(srcKey))
+	if !overwrite {
+		header.Set("If-None-Match", "*")
+	}
+	resp, respErr := this.do(ctx, "PUT", destKey, nil, header, nil, 0)
+	if respErr != nil {
+		err = respErr
+		return
+	}
+	resp.Body.Close()
+
+	err = this.Delete(srcKey)
+	return
+}
+
+// send the signed request, the response body must be closed by the caller when err is nil, the conditional
+// request with If-None-Match fails with ErrExists when the object exists
+func (this *S3Store) do(ctx context.Context, method, key string, params url.Values, header http.Header, body io.Reader,
+	size int64) (resp *http.Response, err error) {
+	reqUrl := *this.endpoint
+	if this.pathStyle {
+		reqUrl.Path = "/" + this.bucket
+		reqUrl.RawPath = "/" + s3Escape(this.bucket)
+		if key != "" {
+			reqUrl.Path += "/" + key
+			reqUrl.RawPath += "/" + s3Escape(key)
+		}
+	} else {
+		reqUrl.Host = this.bucket + "." + this.endpoint.Host
+		reqUrl.Path = "/" + key
+		reqUrl.RawPath = "/" + s3Escape(key)
+	}
+	reqUrl.RawQuery = s3CanonicalQuery(params)
+
+	if body != nil && size == 0 {
+		body = http.NoBody
+	}
+	req, reqErr := http.NewRequest(method, reqUrl.String(), body)
+	if reqErr != nil {
+		err = fmt.Errorf("create s3 request failed, %s", reqErr.Error())
+		return
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	this.sign(req, reqUrl.RawPath, reqUrl.RawQuery)
+
+	resp, err = this.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound && method != "GET" {
+			err = ErrNotFound
+			return
+		}
+		if resp.StatusCode == http.StatusPreconditionFailed && req.Header.Get("If-None-Match") != "" {
+			err = ErrExists
+			return
+		}
+		storeErr := &StoreError{
+			Code:    resp.StatusCode,
+			Message: resp.Status,
+		}
+		var respErr s3Error
+		respData, _ := ioutil.ReadAll(resp.Body)
+		if xml.Unmarshal(respData, &respErr) == nil && respErr.Code != "" {
+			storeErr.Message = respErr.Code + ": " + respErr.Message
+		}
+		err = storeErr
+	}
+	return
+}
+
+func (this *S3Store) sign(req *http.Request, canonicalUri, canonicalQuery string) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	dateStamp := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", S3_UNSIGNED_PAYLOAD)
+
+	//the host and all the x-amz- headers such as the user metadata are signed
+	headerNames := []string{"host"}
+	for name := range req.Header {
+		if lowerName := strings.ToLower(name); strings.HasPrefix(lowerName, "x-amz-") {
+			headerNames = append(headerNames, lowerName)
+		}
+	}
+	sort.Strings(headerNames)
+	var canonicalHeaders string
+	for _, name := range headerNames {
+		value := req.URL.Host
+		if name != "host" {
+			value = strings.TrimSpace(req.Header.Get(name))
+		}
+		canonicalHeaders += name + ":" + value + "\n"
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalUri,
+		canonicalQuery,
+		canonicalHeaders,
+		signedHeaders,
+		S3_UNSIGNED_PAYLOAD,
+	}, "\n")
+
+	scope := dateStamp + "/" + this.region + "/s3/aws4_request"
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	signingKey := hmacSha256([]byte("AWS4"+this.secretKey), dateStamp)
+	signingKey = hmacSha256(signingKey, this.region)
+	signingKey = hmacSha256(signingKey, "s3")
+	signingKey = hmacSha256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		this.accessKey, scope, signedHeaders, signature))
+}
+
+// build the header of the object put, the standard headers are sent as they are, and the others are saved
+// as the user metadata
+func s3PutHeader(extra *PutExtra) http.Header {
+	header := http.Header{}
+	if extra.MimeType != "" {
+		header.Set("Content-Type", extra.MimeType)
+	}
+	for name, value := range extra.Headers {
+		if StandardHeaders[http.CanonicalHeaderKey(name)] {
+			header.Set(name, value)
+		} else {
+			header.Set(S3_META_PREFIX+name, value)
+		}
+	}
+	return header
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// escape the string as required by aws signature v4, the slash is kept
+func s3Escape(str string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func s3CanonicalQuery(params url.Values) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	items := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range params[k] {
+			items = append(items, strings.Replace(s3Escape(k), "/", "%2F", -1)+"="+
+				strings.Replace(s3Escape(v), "/", "%2F", -1))
+		}
+	}
+	return strings.Join(items, "&")
+}
@@ -0,0 +1,188 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	STORE_TYPE_QINIU = "qiniu"
+	STORE_TYPE_S3    = "s3"
+	STORE_TYPE_LOCAL = "local"
+
+	//the timeout of one store request, a multipart put is split into requests of one block or part
+	STORE_TIMEOUT = 600 //10 minutes
+)
+
+var (
+	ErrNotFound = errors.New("no such file or directory")
+	ErrExists   = errors.New("file exists")
+)
+
+// StandardHeaders 为 s3 中直接作为对象的 HTTP 头保存的标准头，其他的头作为用户元数据保存，
+// 七牛存储只支持 x-qn-meta- 自定义元数据，不能设置这些头
+var StandardHeaders = map[string]bool{
+	"Cache-Control":       true,
+	"Content-Disposition": true,
+	"Content-Encoding":    true,
+	"Content-Language":    true,
+	"Expires":             true,
+}
+
+// ObjectStore 表示用来保存处理结果的对象存储，每个实例对应一个存储空间，ctx 取消时正在进行的请求立即失败
+type ObjectStore interface {
+	//simple put, used for small data
+	Put(ctx context.Context, key string, data io.Reader, size int64, extra *PutExtra) (PutRet, error)
+	//multipart put, used for large data
+	PutMultipart(ctx context.Context, key string, data io.ReaderAt, size int64, extra *PutExtra) (PutRet, error)
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	//stat the objects in batch, the infos and errors are returned in the order of the keys
+	BatchStat(ctx context.Context, keys []string) ([]ObjectInfo, []error)
+	//list the objects with the prefix after the marker, the returned marker is empty when no more objects
+	List(prefix, marker string, limit int) ([]ObjectInfo, string, error)
+	Delete(key string) error
+	//move the objects in batch, the errors are returned in the order of the moves, and nil when moved
+	BatchMove(ctx context.Context, moves []MoveEntry, overwrite bool) []error
+}
+
+type PutExtra struct {
+	MimeType  string
+	Overwrite bool
+	//the metadata headers saved with the object, such as Cache-Control, the local store ignores them
+	Headers map[string]string
+	//progress file of the multipart put, the uploaded parts are skipped when put again
+	ProgressFile string
+}
+
+type MoveEntry struct {
+	SrcKey  string
+	DestKey string
+}
+
+type PutRet struct {
+	Key  string `json:"key"`
+	Hash string `json:"hash"`
+}
+
+type ObjectInfo struct {
+	Key      string `json:"key"`
+	Hash     string `json:"hash"`
+	Fsize    int64  `json:"fsize"`
+	PutTime  int64  `json:"putTime"`
+	MimeType string `json:"mimeType,omitempty"`
+}
+
+// StoreError 表示存储服务返回的错误，Code 为存储服务的状态码
+type StoreError struct {
+	Code    int
+	Message string
+}
+
+func (this *StoreError) Error() string {
+	return fmt.Sprintf("%d %s", this.Code, this.Message)
+}
+
+// check whether the operation failed with a temporary error and can be retried, the network errors
+// and the server errors including the qiniu callback failure (579) are retryable
+func IsRetryable(err error) bool {
+	switch v := err.(type) {
+	case *StoreError:
+		return v.Code/100 == 5
+	case net.Error:
+		return true
+	}
+	return false
+}
+
+// StoreConfig 为各个命令配置文件中存储相关的选项，默认使用七牛存储
+type StoreConfig struct {
+	StoreType string `json:"store_type,omitempty"`
+	//the timeout of one store request in seconds
+	StoreTimeout int `json:"store_timeout,omitempty"`
+
+	//qiniu store, the up hosts are resolved by bucket when not configured
+	QiniuRegion        string              `json:"qiniu_region,omitempty"`
+	QiniuUpHosts       []string            `json:"qiniu_up_hosts,omitempty"`
+	QiniuBucketUpHosts map[string][]string `json:"qiniu_bucket_up_hosts,omitempty"`
+	QiniuUseHttps      bool                `json:"qiniu_use_https,omitempty"`
+	QiniuUseAcc        bool                `json:"qiniu_use_acc,omitempty"`
+	QiniuUcHost        string              `json:"qiniu_uc_host,omitempty"`
+
+	//qiniu upload token policy
+	QiniuUptokenExpires   int64  `json:"qiniu_uptoken_expires,omitempty"`
+	QiniuDeleteAfterDays  int    `json:"qiniu_delete_after_days,omitempty"`
+	QiniuFileType         int    `json:"qiniu_file_type,omitempty"`
+	QiniuMimeLimit        string `json:"qiniu_mime_limit,omitempty"`
+	QiniuFsizeLimit       int64  `json:"qiniu_fsize_limit,omitempty"`
+	QiniuReturnBody       string `json:"qiniu_return_body,omitempty"`
+	QiniuCallbackUrl      string `json:"qiniu_callback_url,omitempty"`
+	QiniuCallbackBody     string `json:"qiniu_callback_body,omitempty"`
+	QiniuCallbackBodyType string `json:"qiniu_callback_body_type,omitempty"`
+
+	//s3 compatible store
+	S3Endpoint  string `json:"s3_endpoint,omitempty"`
+	S3Region    string `json:"s3_region,omitempty"`
+	S3AccessKey string `json:"s3_access_key,omitempty"`
+	S3SecretKey string `json:"s3_secret_key,omitempty"`
+	S3PathStyle bool   `json:"s3_path_style,omitempty"`
+
+	//local directory store
+	LocalRoot string `json:"local_root,omitempty"`
+}
+
+func (this *StoreConfig) Check() (err error) {
+	switch this.StoreType {
+	case "", STORE_TYPE_QINIU:
+		if this.QiniuRegion != "" {
+			if _, ok := QiniuRegions[this.QiniuRegion]; !ok {
+				err = fmt.Errorf("unknown qiniu region '%s'", this.QiniuRegion)
+				return
+			}
+		}
+		if this.QiniuCallbackUrl != "" && this.QiniuCallbackBody == "" {
+			err = errors.New("qiniu store requires qiniu_callback_body when qiniu_callback_url is set")
+		}
+	case STORE_TYPE_S3:
+		if this.S3Endpoint == "" || this.S3AccessKey == "" || this.S3SecretKey == "" {
+			err = errors.New("s3 store requires s3_endpoint, s3_access_key and s3_secret_key")
+		}
+	case STORE_TYPE_LOCAL:
+		if this.LocalRoot == "" {
+			err = errors.New("local store requires local_root")
+		}
+	default:
+		err = fmt.Errorf("unsupported store type '%s'", this.StoreType)
+	}
+	return
+}
+
+// create the http client of the store, so that a stalled request can not block the job forever
+func newStoreClient(cfg *StoreConfig) *http.Client {
+	storeTimeout := cfg.StoreTimeout
+	if storeTimeout <= 0 {
+		storeTimeout = STORE_TIMEOUT
+	}
+	return &http.Client{
+		Timeout: time.Duration(storeTimeout) * time.Second,
+	}
+}
+
+// create the object store of the bucket, the upload token manager is used by qiniu store
+func New(cfg *StoreConfig, tokens *UptokenManager, bucket string) (objStore ObjectStore, err error) {
+	switch cfg.StoreType {
+	case "", STORE_TYPE_QINIU:
+		objStore = NewQiniuStore(cfg, tokens, bucket)
+	case STORE_TYPE_S3:
+		objStore = NewS3Store(cfg, bucket)
+	case STORE_TYPE_LOCAL:
+		objStore, err = NewLocalStore(cfg.LocalRoot, bucket)
+	default:
+		err = fmt.Errorf("unsupported store type '%s'", cfg.StoreType)
+	}
+	return
+}
@@ -0,0 +1,163 @@
+package ufop
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/qiniu/log"
+)
+
+const (
+	TLS_RELOAD_INTERVAL = 60 //seconds
+)
+
+// UfopTlsLoader 负责加载服务的证书和用来校验客户端证书的 CA，证书文件更新后会在握手时自动重新加载，不需要重启服务
+type UfopTlsLoader struct {
+	certFile       string
+	keyFile        string
+	clientCaFile   string
+	reloadInterval time.Duration
+
+	lock      sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func NewTlsLoader(cfg *UfopConfig) (loader *UfopTlsLoader, err error) {
+	if cfg.TlsCertFile == "" || cfg.TlsKeyFile == "" {
+		err = errors.New("tls requires both tls_cert_file and tls_key_file")
+		return
+	}
+
+	reloadInterval := cfg.TlsReloadInterval
+	if reloadInterval <= 0 {
+		reloadInterval = TLS_RELOAD_INTERVAL
+	}
+	loader = &UfopTlsLoader{
+		certFile:       cfg.TlsCertFile,
+		keyFile:        cfg.TlsKeyFile,
+		clientCaFile:   cfg.TlsClientCaFile,
+		reloadInterval: time.Duration(reloadInterval) * time.Second,
+	}
+	err = loader.Reload()
+	return
+}
+
+// load the certificate and the client ca files, the old ones are kept when failed
+func (this *UfopTlsLoader) Reload() (err error) {
+	modTime, statErr := this.filesModTime()
+	if statErr != nil {
+		err = statErr
+		return
+	}
+
+	cert, certErr := tls.LoadX509KeyPair(this.certFile, this.keyFile)
+	if certErr != nil {
+		err = fmt.Errorf("load tls certificate failed, %s", certErr.Error())
+		return
+	}
+
+	var clientCAs *x509.CertPool
+	if this.clientCaFile != "" {
+		caData, readErr := ioutil.ReadFile(this.clientCaFile)
+		if readErr != nil {
+			err = fmt.Errorf("load tls client ca failed, %s", readErr.Error())
+			return
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caData) {
+			err = errors.New("load tls client ca failed, no valid certificate found")
+			return
+		}
+	}
+
+	this.lock.Lock()
+	this.cert = &cert
+	this.clientCAs = clientCAs
+	this.modTime = modTime
+	this.checkedAt = time.Now()
+	this.lock.Unlock()
+	return
+}
+
+func (this *UfopTlsLoader) filesModTime() (modTime time.Time, err error) {
+	for _, file := range []string{this.certFile, this.keyFile, this.clientCaFile} {
+		if file == "" {
+			continue
+		}
+		fileInfo, statErr := os.Stat(file)
+		if statErr != nil {
+			err = fmt.Errorf("stat tls file failed, %s", statErr.Error())
+			return
+		}
+		if fileInfo.ModTime().After(modTime) {
+			modTime = fileInfo.ModTime()
+		}
+	}
+	return
+}
+
+// reload the files if they are modified since the last load, checked at most once in the reload interval
+func (this *UfopTlsLoader) checkReload() {
+	this.lock.Lock()
+	if time.Since(this.checkedAt) < this.reloadInterval {
+		this.lock.Unlock()
+		return
+	}
+	this.checkedAt = time.Now()
+	lastModTime := this.modTime
+	this.lock.Unlock()
+
+	modTime, statErr := this.filesModTime()
+	if statErr != nil {
+		log.Error(statErr)
+		return
+	}
+	if !modTime.After(lastModTime) {
+		return
+	}
+	if reloadErr := this.Reload(); reloadErr != nil {
+		log.Error("reload tls files error,", reloadErr)
+		return
+	}
+	log.Info("tls files reloaded")
+}
+
+func (this *UfopTlsLoader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	this.checkReload()
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return this.cert, nil
+}
+
+// the tls config for the server, client certificates are required and verified when the client ca is configured
+func (this *UfopTlsLoader) TlsConfig(nextProtos []string) *tls.Config {
+	return &tls.Config{
+		NextProtos:     nextProtos,
+		GetCertificate: this.getCertificate,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			this.checkReload()
+
+			this.lock.RLock()
+			defer this.lock.RUnlock()
+			clientCfg := &tls.Config{
+				Certificates: []tls.Certificate{*this.cert},
+				NextProtos:   nextProtos,
+			}
+			if this.clientCAs != nil {
+				clientCfg.ClientCAs = this.clientCAs
+				clientCfg.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return clientCfg, nil
+		},
+	}
+}
@@ -1,40 +1,221 @@
 package utils
 
 import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
 	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
 )
 
-var gbkDecoder = simplifiedchinese.GBK.NewDecoder()
-var gbkEncoder = simplifiedchinese.GBK.NewEncoder()
+const (
+	CHARSET_UTF8      = "utf8"
+	CHARSET_GBK       = "gbk"
+	CHARSET_GB18030   = "gb18030"
+	CHARSET_BIG5      = "big5"
+	CHARSET_SHIFT_JIS = "shift_jis"
+	CHARSET_EUC_KR    = "euc-kr"
+	CHARSET_CP437     = "cp437"
+)
 
-func Gbk2Utf8(text string) (string, error) {
-	utf8Dst := make([]byte, len(text)*3)
-	_, _, err := gbkDecoder.Transform(utf8Dst, []byte(text), true)
-	if err != nil {
-		return "", err
-	}
-	gbkDecoder.Reset()
-	utf8Bytes := make([]byte, 0)
-	for _, b := range utf8Dst {
-		if b != 0 {
-			utf8Bytes = append(utf8Bytes, b)
+var charsetEncodings = map[string]encoding.Encoding{
+	CHARSET_GBK:       simplifiedchinese.GBK,
+	CHARSET_GB18030:   simplifiedchinese.GB18030,
+	CHARSET_BIG5:      traditionalchinese.Big5,
+	CHARSET_SHIFT_JIS: japanese.ShiftJIS,
+	CHARSET_EUC_KR:    korean.EUCKR,
+	CHARSET_CP437:     charmap.CodePage437,
+}
+
+var charsetAliases = map[string]string{
+	"utf-8":     CHARSET_UTF8,
+	"gb2312":    CHARSET_GBK,
+	"cp936":     CHARSET_GBK,
+	"big-5":     CHARSET_BIG5,
+	"cp950":     CHARSET_BIG5,
+	"shift-jis": CHARSET_SHIFT_JIS,
+	"sjis":      CHARSET_SHIFT_JIS,
+	"cp932":     CHARSET_SHIFT_JIS,
+	"euckr":     CHARSET_EUC_KR,
+	"euc_kr":    CHARSET_EUC_KR,
+	"cp949":     CHARSET_EUC_KR,
+	"ibm437":    CHARSET_CP437,
+}
+
+//the candidates of the detection, in the order of preference when the scores are equal
+var detectCharsets = []string{
+	CHARSET_GB18030,
+	CHARSET_BIG5,
+	CHARSET_SHIFT_JIS,
+	CHARSET_EUC_KR,
+	CHARSET_CP437,
+}
+
+//the frequently used characters, which are used to score the decoded names
+var commonChars = make(map[rune]bool)
+
+const (
+	commonSimplifiedChars = "的一是不了在人有我他这个们中来上大为和国地到以说时要就出会可也你对生能而子那得于着下" +
+		"自之年过发后作里用道行所然家种事成方多经么去法学如都同现当没动面起看定天分还进好小部其些主样理心她本前开" +
+		"但因只从想实日军者意无力它与长把机十民第公此已工使情明性知全三又关点正业外将两高间由问很最重并物手应战向" +
+		"头文体政美相见被利什二等产或新己制身果加西斯月话合回特代内信表化老给世位次度门任常先海通教儿原东声提立及" +
+		"比员解水名真论处走义各入几口认条平系气题活尔更别打女变四神总何电数安少报才结反受目太量再感建务做接必场件" +
+		"计管期市直德资命山金指克许统区保至队形社便空决治展马科司五基眼书非则听白却界达光放强即像难且权思王象完设" +
+		"式色路记南品住告类求据程北边死张该交规万取拉格望觉术领共确传师观清今切院让识候带导争运笑飞风步改收根干造" +
+		"言联持组每济车亲极林服快办议往元英士证近失转夫令准布始怎存未远叫台单影具罗字爱击流备兵连调深商算质团集百" +
+		"需价花华城石级整府离况亚请技际约示复病息究线似官火断精满支视消越器容照须九增研写称企八功包片史委查轻易早" +
+		"除农找装广显阿李标谈吃图念六引历首医局突专费号尽另周较注语仅考落青随选列武红响虽推势参希古众构房半节土投" +
+		"某案黑维革划致陈律足态护七兴派孩验责营星够章音跟志底站严巴例防族供效续施留讲型料终答紧黄绝奇察母京段依批" +
+		"群项故按河米围江织害双境客纪采举父苏密低朝友止细愿千值男钱破网热助育属坐限船职速刻乐否刚毛状率独球般普校" +
+		"苦创假久错承印晚兰试股拿脑预益阳若微尼继送急血素药适波夜省初喜卫源食险待述陆习置居劳财环排福纳欢雷获模充" +
+		"负云停木游龙树层冷洲射略范句室异激汉村策演简卡判州静退衣宗积余检差富灵协角配征修皮降阶审坚善读超免压银买" +
+		"养执副乱追帮宣佛岁航优香田铁控税左右份穿艺背草脚概块顿守酒岛央户洋索款靠评版宝座释景顾弟登货互付慢欧换闻" +
+		"核介良序升监临亮露永呼味野架域沙括鱼杂误湾吉减编楚测屋梦散温困渐封救贵缺楼县移画班智短掌固席松秘谢遇康虑" +
+		"均销钟诗藏剧票损巨旧端探湖录叶春乡附吸予礼港雨板庭妇归含顺输招婚补督油疗旅材笔词择寻厂博授岸唐卖健堂旁宫" +
+		"档案夹照视频课件像素附份副介说明册计划总汇练习试卷稿封面简历目录备注模板新建复制"
+	commonTraditionalChars = "這個們來為國說時會對於著過發後裡經麼學現當沒動還進樣從實軍與長機無點業將兩間問" +
+		"題應戰頭體見產話內給門東聲員論處義幾認條氣爾別變神總電數報結務場計資區隊決書聽卻達強難權設記邊張該規萬覺" +
+		"術領確傳師觀院讓識帶導爭運飛風轉準單羅愛擊備連調質團價華級離況亞請際約復視須稱嗎圖歷醫專費號盡較語僅隨選" +
+		"紅響雖勢參眾構節劃維護興驗責營夠嚴續講終緊黃絕圍織雙紀採舉殺蘇訴細願錢網熱屬職樂剛狀獨彈創錯試腦預誰陽繼" +
+		"驚傷藥衛險陸習勞財環納歡獲負雲遊龍樹層範漢簡擔靜積餘檢靈協徵修揮勝階審堅媽讀壓銀買養懷執亂幫歲優鐵稅藝陣" +
+		"腳惡塊頓島託戶評寶釋顧貨歐換聞壞討麗監臨艦魚雜誤灣減編測敗夢溫劍漸貴槍樓縣畫遺謝魯慮銷鐘詩劇損舊錄葉鄉" +
+		"禮婦歸飯額順輸搖補謂療澤滅筆詞聖擇尋廠煙諾倫賣載陰園謀榮孫頂鎮練爺館礎紙諸訓莊絲戲隱訪軟夥盤擴蓋穩億擁楊" +
+		"齊賽虛購揚綠貿畢輪庫跡競棄偉緩潛閃燈針絡純頁傑築鄭貝吳擺毀趙側檔案夾視頻課件錄說明冊劃總匯練試卷簡歷錄備註" +
+		"範複製"
+	commonHangulChars = "이의가에는을를하고다지한로기사서도리자대인수시나아정보일어제전상부소중구문화계있해주방국내위업" +
+		"스트그거우연장개관성경유동만원무여신공라더것없요및작선실비생회설명결과자료사진영상파일폴더문서보고서계획" +
+		"목록양식본최종수정백업새학교과제강의발표회의견적계약서류첨부사본복사편집" +
+		"출제학생님년월번호름반팀별용참고요약안내신청접수결산예산월간주간"
+	commonKanaChars = "ぁあぃいぅうぇえぉおかがきぎくぐけげこごさざしじすずせぜそぞただちぢっつづてでとどなにぬねのはばぱひび" +
+		"ぴふぶぷへべぺほぼぽまみむめもゃやゅゆょよらりるれろゎわゐゑをんァアィイゥウェエォオカガキギクグケゲコゴサ" +
+		"ザシジスズセゼソゾタダチヂッツヅテデトドナニヌネノハバパヒビピフブプヘベペホボポマミムメモャヤュユョヨラリ" +
+		"ルレロヮワヰヱヲンヴヵヶー資料写真動画書類報告議事録企画提案見積請求契約名簿一覧"
+)
+
+func init() {
+	for _, chars := range []string{commonSimplifiedChars, commonTraditionalChars, commonHangulChars, commonKanaChars} {
+		for _, r := range chars {
+			commonChars[r] = true
 		}
 	}
-	return string(utf8Bytes), nil
 }
 
-func Utf82Gbk(text string) (string, error) {
-	gbkDst := make([]byte, len(text)*2)
-	_, _, err := gbkEncoder.Transform(gbkDst, []byte(text), true)
-	if err != nil {
-		return "", err
+// get the canonical charset name, the aliases like 'gb2312', 'sjis' and 'cp949' are accepted
+func LookupCharset(name string) (charset string, err error) {
+	charset = strings.ToLower(strings.TrimSpace(name))
+	if alias, ok := charsetAliases[charset]; ok {
+		charset = alias
+	}
+	if _, ok := charsetEncodings[charset]; !ok && charset != CHARSET_UTF8 {
+		err = fmt.Errorf("unsupported charset '%s'", name)
+	}
+	return
+}
+
+// decode the text in the charset to utf8, the invalid bytes are replaced by U+FFFD
+func DecodeString(charset, text string) (string, error) {
+	if charset == CHARSET_UTF8 {
+		return strings.ToValidUTF8(text, string(utf8.RuneError)), nil
+	}
+	enc, ok := charsetEncodings[charset]
+	if !ok {
+		return "", fmt.Errorf("unsupported charset '%s'", charset)
+	}
+	return enc.NewDecoder().String(text)
+}
+
+// encode the utf8 text to the charset, fail if any character can not be represented in the charset
+func EncodeString(charset, text string) (string, error) {
+	if charset == CHARSET_UTF8 {
+		return text, nil
+	}
+	enc, ok := charsetEncodings[charset]
+	if !ok {
+		return "", fmt.Errorf("unsupported charset '%s'", charset)
+	}
+	encoded, encErr := enc.NewEncoder().String(text)
+	if encErr != nil {
+		return "", fmt.Errorf("'%s' can not be encoded in %s", text, charset)
+	}
+	return encoded, nil
+}
+
+// detect the charset of the names in an archive, all the names are decoded by each candidate charset,
+// the candidate which fails to decode any name is dropped, and the one with the highest score wins
+func DetectCharset(names []string) string {
+	allValid := true
+	for _, name := range names {
+		if !utf8.ValidString(name) {
+			allValid = false
+			break
+		}
+	}
+	if allValid {
+		return CHARSET_UTF8
+	}
+
+	bestCharset := CHARSET_CP437
+	bestScore := -1 << 31
+	for _, charset := range detectCharsets {
+		score, ok := scoreCharset(charset, names)
+		if ok && score > bestScore {
+			bestCharset = charset
+			bestScore = score
+		}
 	}
-	gbkEncoder.Reset()
-	gbkBytes := make([]byte, 0)
-	for _, b := range gbkDst {
-		if b != 0 {
-			gbkBytes = append(gbkBytes, b)
+	return bestCharset
+}
+
+func scoreCharset(charset string, names []string) (score int, ok bool) {
+	decoder := charsetEncodings[charset].NewDecoder()
+	for _, name := range names {
+		decoded, decodeErr := decoder.String(name)
+		if decodeErr != nil {
+			return
 		}
+		for _, r := range decoded {
+			if r < utf8.RuneSelf {
+				if r < 0x20 || r == 0x7f {
+					return
+				}
+				continue
+			}
+			rScore, valid := scoreRune(r)
+			if !valid {
+				return
+			}
+			score += rScore
+		}
+	}
+	ok = true
+	return
+}
+
+// score the decoded character, the frequently used characters get the highest score, and the characters
+// which are seldom used in names reduce the score, the invalid characters mean a wrong charset
+func scoreRune(r rune) (score int, valid bool) {
+	switch {
+	case r == utf8.RuneError || unicode.IsControl(r) || unicode.Is(unicode.Co, r):
+		return 0, false
+	case commonChars[r]:
+		return 3, true
+	case unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hangul, r) ||
+		unicode.Is(unicode.Hiragana, r) || unicode.Is(unicode.Katakana, r) && r < 0xff00:
+		return 0, true
+	case r >= 0x3000 && r <= 0x303f, r >= 0xff01 && r <= 0xff5e:
+		//cjk and fullwidth punctuations
+		return 1, true
+	case r >= 0xff61 && r <= 0xff9f:
+		//halfwidth katakana, mostly from a wrong charset
+		return -1, true
+	case unicode.Is(unicode.Latin, r):
+		return 1, true
 	}
-	return string(gbkBytes), nil
+	return -1, true
 }
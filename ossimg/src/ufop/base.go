@@ -17,11 +17,13 @@ const (
 )
 
 // UfopRequest 表示 UFOP转发请求体，其中 MimeType 为 Url 所指定资源的 Content-Type
+// Job 用来记录请求的处理进度，请求被取消时处理程序应当尽快结束处理
 type UfopRequest struct {
-	Cmd      string `json:"cmd"`
-	Url      string `json:"url"`
-	MimeType string `json:"-"`
-	ReqId    string `json:"-"`
+	Cmd      string   `json:"cmd"`
+	Url      string   `json:"url"`
+	MimeType string   `json:"-"`
+	Job      *UfopJob `json:"-"`
+	ReqId    string   `json:"-"`
 }
 
 type UfopJobHandler interface {
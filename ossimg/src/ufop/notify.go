@@ -0,0 +1,190 @@
+package ufop
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/qiniu/log"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	NOTIFY_MAX_RETRIES       = 5
+	NOTIFY_TIMEOUT           = 30  //30s
+	NOTIFY_MAX_RETRY_BACKOFF = 300 //5min
+)
+
+const (
+	NOTIFY_HEADER_REQID     = "X-Ufop-Reqid"
+	NOTIFY_HEADER_TIMESTAMP = "X-Ufop-Timestamp"
+	NOTIFY_HEADER_SIGNATURE = "X-Ufop-Signature"
+)
+
+var notifyParamRegx = regexp.MustCompile("/notify/[0-9a-zA-Z-_=]+$")
+
+// UfopNotification 为任务完成后回调给 notify url 的内容，JSON 类型的处理结果放在 Result 中，
+// 其他类型的处理结果只给出 ContentType
+type UfopNotification struct {
+	ReqId       string      `json:"reqId"`
+	Cmd         string      `json:"cmd"`
+	Url         string      `json:"url,omitempty"`
+	Code        int         `json:"code"`
+	Error       string      `json:"error,omitempty"`
+	ContentType string      `json:"contentType,omitempty"`
+	Result      interface{} `json:"result,omitempty"`
+}
+
+type UfopNotifier struct {
+	defaultUrl string
+	secret     string
+	hosts      []string
+	maxRetries int
+	client     *http.Client
+}
+
+func NewNotifier(cfg *UfopConfig) *UfopNotifier {
+	notifier := UfopNotifier{
+		defaultUrl: cfg.NotifyUrl,
+		secret:     cfg.NotifySecret,
+		hosts:      cfg.NotifyHosts,
+		maxRetries: cfg.NotifyMaxRetries,
+	}
+	if notifier.maxRetries <= 0 {
+		notifier.maxRetries = NOTIFY_MAX_RETRIES
+	}
+	notifyTimeout := cfg.NotifyTimeout
+	if notifyTimeout <= 0 {
+		notifyTimeout = NOTIFY_TIMEOUT
+	}
+	notifier.client = &http.Client{
+		Timeout: time.Duration(notifyTimeout) * time.Second,
+	}
+	return &notifier
+}
+
+// strip the optional /notify/<encoded url> suffix from the cmd, and return the notify url
+// of the request, which falls back to the notify url in the config, the notify url in the cmd
+// is only allowed on the notify hosts, so the server is not used to post to the internal addresses
+func (this *UfopNotifier) parse(cmd string) (notifyUrl string, newCmd string, err error) {
+	newCmd = cmd
+	notifyParam := notifyParamRegx.FindString(cmd)
+	if notifyParam == "" {
+		notifyUrl = this.defaultUrl
+		return
+	}
+
+	newCmd = strings.TrimSuffix(cmd, notifyParam)
+	notifyUrlBytes, decodeErr := base64.URLEncoding.DecodeString(strings.TrimPrefix(notifyParam, "/notify/"))
+	if decodeErr != nil {
+		err = errors.New("invalid parameter 'notify'")
+		return
+	}
+	notifyUrl = string(notifyUrlBytes)
+	if !this.allowed(notifyUrl) {
+		err = errors.New("invalid parameter 'notify', host not allowed")
+		return
+	}
+	return
+}
+
+// the url must be http or https, and the host matches one of the notify hosts, the host starting with
+// '*.' matches all its sub domains
+func (this *UfopNotifier) allowed(notifyUrl string) bool {
+	parsedUrl, parseErr := url.Parse(notifyUrl)
+	if parseErr != nil || (parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https") {
+		return false
+	}
+	hostname := strings.ToLower(parsedUrl.Hostname())
+	for _, host := range this.hosts {
+		host = strings.ToLower(host)
+		if host == hostname || host == strings.ToLower(parsedUrl.Host) {
+			return true
+		}
+		if strings.HasPrefix(host, "*.") && strings.HasSuffix(hostname, host[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// send the notification in background, retry with exponential backoff when failed
+func (this *UfopNotifier) Notify(notifyUrl string, notification UfopNotification) {
+	body, mErr := json.Marshal(&notification)
+	if mErr != nil {
+		log.Errorf("[%s] encode notification error, %s", notification.ReqId, mErr.Error())
+		return
+	}
+
+	go func() {
+		backoff := time.Second
+		for retry := 0; ; retry++ {
+			retryable, nErr := this.post(notifyUrl, notification.ReqId, body)
+			if nErr == nil {
+				log.Infof("[%s] notify %s success", notification.ReqId, notifyUrl)
+				return
+			}
+
+			if !retryable || retry >= this.maxRetries {
+				log.Errorf("[%s] notify %s failed, %s", notification.ReqId, notifyUrl, nErr.Error())
+				return
+			}
+
+			log.Warnf("[%s] notify %s failed, retry after %s, %s", notification.ReqId, notifyUrl, backoff, nErr.Error())
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > NOTIFY_MAX_RETRY_BACKOFF*time.Second {
+				backoff = NOTIFY_MAX_RETRY_BACKOFF * time.Second
+			}
+		}
+	}()
+}
+
+func (this *UfopNotifier) post(notifyUrl, reqId string, body []byte) (retryable bool, err error) {
+	req, reqErr := http.NewRequest("POST", notifyUrl, bytes.NewReader(body))
+	if reqErr != nil {
+		err = fmt.Errorf("create notify request error, %s", reqErr.Error())
+		return
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", CONTENT_TYPE_JSON)
+	req.Header.Set(NOTIFY_HEADER_REQID, reqId)
+	req.Header.Set(NOTIFY_HEADER_TIMESTAMP, timestamp)
+	req.Header.Set(NOTIFY_HEADER_SIGNATURE, "sha256="+this.sign(timestamp, body))
+
+	resp, respErr := this.client.Do(req)
+	if respErr != nil {
+		retryable = true
+		err = respErr
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		retryable = resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests
+		err = fmt.Errorf("notify response %s", resp.Status)
+	}
+	return
+}
+
+// the signature is the hex encoded HMAC-SHA256 of "<timestamp>.<body>" keyed by the notify secret
+func (this *UfopNotifier) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(this.secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,71 @@
+package store
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"hash"
+	"io"
+)
+
+const (
+	ETAG_BLOCK_SIZE = 4 * 1024 * 1024 //4MB
+)
+
+// EtagHasher 用来计算和七牛存储一致的文件 etag，即按 4MB 分块计算 sha1 后再合并
+type EtagHasher struct {
+	blockHash  hash.Hash
+	blockSize  int
+	blockSha1s []byte
+}
+
+func NewEtagHasher() *EtagHasher {
+	return &EtagHasher{
+		blockHash: sha1.New(),
+	}
+}
+
+func (this *EtagHasher) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		toWrite := ETAG_BLOCK_SIZE - this.blockSize
+		if toWrite > len(p) {
+			toWrite = len(p)
+		}
+		this.blockHash.Write(p[:toWrite])
+		this.blockSize += toWrite
+		n += toWrite
+		p = p[toWrite:]
+
+		if this.blockSize == ETAG_BLOCK_SIZE {
+			this.blockSha1s = this.blockHash.Sum(this.blockSha1s)
+			this.blockHash.Reset()
+			this.blockSize = 0
+		}
+	}
+	return
+}
+
+func (this *EtagHasher) Etag() string {
+	blockSha1s := this.blockSha1s
+	if this.blockSize > 0 || len(blockSha1s) == 0 {
+		blockSha1s = this.blockHash.Sum(blockSha1s)
+	}
+
+	var etag []byte
+	if len(blockSha1s) == sha1.Size {
+		etag = append([]byte{0x16}, blockSha1s...)
+	} else {
+		h := sha1.New()
+		h.Write(blockSha1s)
+		etag = h.Sum([]byte{0x96})
+	}
+	return base64.URLEncoding.EncodeToString(etag)
+}
+
+func Etag(data io.Reader) (etag string, err error) {
+	hasher := NewEtagHasher()
+	if _, err = io.Copy(hasher, data); err != nil {
+		return
+	}
+	etag = hasher.Etag()
+	return
+}
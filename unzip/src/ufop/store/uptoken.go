@@ -0,0 +1,119 @@
+package store
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/qiniu/api.v6/auth/digest"
+)
+
+const (
+	QINIU_UPTOKEN_EXPIRES       = 24 * 3600 //24 hours
+	QINIU_UPTOKEN_REFRESH_AHEAD = 300       //refresh the token 5 minutes before it expires
+	QINIU_UPTOKEN_CACHE_SIZE    = 10000
+)
+
+type qiniuPutPolicy struct {
+	Scope            string `json:"scope"`
+	Deadline         int64  `json:"deadline"`
+	ReturnBody       string `json:"returnBody,omitempty"`
+	CallbackUrl      string `json:"callbackUrl,omitempty"`
+	CallbackBody     string `json:"callbackBody,omitempty"`
+	CallbackBodyType string `json:"callbackBodyType,omitempty"`
+	FsizeLimit       int64  `json:"fsizeLimit,omitempty"`
+	MimeLimit        string `json:"mimeLimit,omitempty"`
+	DeleteAfterDays  int    `json:"deleteAfterDays,omitempty"`
+	FileType         int    `json:"fileType,omitempty"`
+}
+
+type uptokenCacheItem struct {
+	uptoken  string
+	deadline time.Time
+}
+
+// UptokenManager 按照 bucket 或者 bucket:key 的 scope 生成七牛上传凭证，
+// 凭证在过期前会被缓存复用，凭证中的其他策略字段来自存储配置
+type UptokenManager struct {
+	cfg *StoreConfig
+	mac *digest.Mac
+
+	lock  sync.Mutex
+	cache map[string]uptokenCacheItem
+}
+
+func NewUptokenManager(cfg *StoreConfig, mac *digest.Mac) *UptokenManager {
+	return &UptokenManager{
+		cfg:   cfg,
+		mac:   mac,
+		cache: make(map[string]uptokenCacheItem),
+	}
+}
+
+func (this *UptokenManager) Mac() *digest.Mac {
+	return this.mac
+}
+
+// get the upload token of the bucket, the scope is limited to the key when overwrite is allowed
+func (this *UptokenManager) Uptoken(bucket, key string, overwrite bool) (uptoken string, err error) {
+	scope := bucket
+	if overwrite {
+		scope = bucket + ":" + key
+	}
+
+	now := time.Now()
+	this.lock.Lock()
+	cacheItem, ok := this.cache[scope]
+	this.lock.Unlock()
+	if ok && now.Before(cacheItem.deadline) {
+		uptoken = cacheItem.uptoken
+		return
+	}
+
+	expires := this.cfg.QiniuUptokenExpires
+	if expires <= 0 {
+		expires = QINIU_UPTOKEN_EXPIRES
+	}
+	policy := qiniuPutPolicy{
+		Scope:            scope,
+		Deadline:         now.Unix() + expires,
+		ReturnBody:       this.cfg.QiniuReturnBody,
+		CallbackUrl:      this.cfg.QiniuCallbackUrl,
+		CallbackBody:     this.cfg.QiniuCallbackBody,
+		CallbackBodyType: this.cfg.QiniuCallbackBodyType,
+		FsizeLimit:       this.cfg.QiniuFsizeLimit,
+		MimeLimit:        this.cfg.QiniuMimeLimit,
+		DeleteAfterDays:  this.cfg.QiniuDeleteAfterDays,
+		FileType:         this.cfg.QiniuFileType,
+	}
+	policyData, mErr := json.Marshal(&policy)
+	if mErr != nil {
+		err = mErr
+		return
+	}
+	uptoken = this.mac.SignWithData(policyData)
+
+	//tokens with short lifetime are not cached
+	refreshAhead := int64(QINIU_UPTOKEN_REFRESH_AHEAD)
+	if expires <= refreshAhead {
+		return
+	}
+
+	this.lock.Lock()
+	if len(this.cache) >= QINIU_UPTOKEN_CACHE_SIZE {
+		for cacheScope, item := range this.cache {
+			if !now.Before(item.deadline) {
+				delete(this.cache, cacheScope)
+			}
+		}
+		if len(this.cache) >= QINIU_UPTOKEN_CACHE_SIZE {
+			this.cache = make(map[string]uptokenCacheItem)
+		}
+	}
+	this.cache[scope] = uptokenCacheItem{
+		uptoken:  uptoken,
+		deadline: now.Add(time.Duration(expires-refreshAhead) * time.Second),
+	}
+	this.lock.Unlock()
+	return
+}
@@ -0,0 +1,272 @@
+package unzip
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"ufop"
+
+	"github.com/qiniu/log"
+	"github.com/ulikunitz/xz"
+)
+
+const (
+	ARCHIVE_FORMAT_ZIP     = "zip"
+	ARCHIVE_FORMAT_TAR     = "tar"
+	ARCHIVE_FORMAT_TAR_GZ  = "tar.gz"
+	ARCHIVE_FORMAT_TAR_BZ2 = "tar.bz2"
+	ARCHIVE_FORMAT_TAR_XZ  = "tar.xz"
+)
+
+const (
+	//the tar header block size, the magic 'ustar' is at offset 257 of the first block
+	TAR_BLOCK_SIZE        = 512
+	TAR_MAGIC_OFFSET      = 257
+	ARCHIVE_PEEK_BUF_SIZE = 64 * 1024
+)
+
+var archiveFormatAliases = map[string]string{
+	ARCHIVE_FORMAT_ZIP:     ARCHIVE_FORMAT_ZIP,
+	ARCHIVE_FORMAT_TAR:     ARCHIVE_FORMAT_TAR,
+	ARCHIVE_FORMAT_TAR_GZ:  ARCHIVE_FORMAT_TAR_GZ,
+	ARCHIVE_FORMAT_TAR_BZ2: ARCHIVE_FORMAT_TAR_BZ2,
+	ARCHIVE_FORMAT_TAR_XZ:  ARCHIVE_FORMAT_TAR_XZ,
+	"tgz":                  ARCHIVE_FORMAT_TAR_GZ,
+	"tbz2":                 ARCHIVE_FORMAT_TAR_BZ2,
+	"txz":                  ARCHIVE_FORMAT_TAR_XZ,
+}
+
+// the extensions of the nested archives, the longer ones are matched first
+var nestedArchiveExts = []struct {
+	ext    string
+	format string
+}{
+	{".tar.gz", ARCHIVE_FORMAT_TAR_GZ},
+	{".tar.bz2", ARCHIVE_FORMAT_TAR_BZ2},
+	{".tar.xz", ARCHIVE_FORMAT_TAR_XZ},
+	{".zip", ARCHIVE_FORMAT_ZIP},
+	{".tar", ARCHIVE_FORMAT_TAR},
+	{".tgz", ARCHIVE_FORMAT_TAR_GZ},
+	{".tbz2", ARCHIVE_FORMAT_TAR_BZ2},
+	{".txz", ARCHIVE_FORMAT_TAR_XZ},
+}
+
+var (
+	magicZip      = []byte("PK\x03\x04")
+	magicZipEmpty = []byte("PK\x05\x06")
+	magicGzip     = []byte("\x1f\x8b")
+	magicBzip2    = []byte("BZh")
+	magicXz       = []byte("\xfd7zXZ\x00")
+	magicTar      = []byte("ustar")
+)
+
+var errArchiveTooLarge = errors.New("src zip file length exceeds the limit")
+
+// unzipArchive 为打开的压缩包，zip 格式通过 ZipData 随机读取，其他格式通过 Stream 流式读取，
+// 通过 Range 请求读取的远程 zip 压缩包不会下载到本地，ETag 为源站返回的 ETag
+type unzipArchive struct {
+	Format  string
+	Stream  io.Reader
+	ZipData io.ReaderAt
+	Size    int64
+	ETag    string
+
+	reqId       string
+	rangeReader *httpRangeReader
+	closers     []io.Closer
+}
+
+// open the archive of the source, the large remote zip file is read by range requests, the others are downloaded
+// from the url or read from the request body, the archive must be closed after used
+func (this *Unzipper) openArchive(req ufop.UfopRequest, params UnzipParams, ufopBody io.ReadCloser) (
+	archive *unzipArchive, err error) {
+	if rangeReader := this.openRangeReader(req, params); rangeReader != nil {
+		log.Infof("[%s] content length: %d, read by range requests", req.ReqId, rangeReader.Size)
+		if rangeReader.Size > this.maxZipFileLength {
+			err = errArchiveTooLarge
+			return
+		}
+		archive = &unzipArchive{
+			Format:      ARCHIVE_FORMAT_ZIP,
+			ZipData:     rangeReader,
+			Size:        rangeReader.Size,
+			ETag:        rangeReader.ETag,
+			reqId:       req.ReqId,
+			rangeReader: rangeReader,
+		}
+		return
+	}
+
+	log.Infof("[%s] reading source data", req.ReqId)
+	src, srcErr := ufop.OpenSource(req, ufopBody)
+	if srcErr != nil {
+		err = srcErr
+		return
+	}
+	log.Infof("[%s] content length: %d, content type: %s", req.ReqId, src.Size, src.MimeType)
+	if src.Size > this.maxZipFileLength {
+		src.Close()
+		err = errArchiveTooLarge
+		return
+	}
+
+	archive, err = this.readArchive(req, params.Format, src.Body, src.Size)
+	if err != nil {
+		src.Close()
+		return
+	}
+	archive.ETag = src.ETag
+	archive.closers = append(archive.closers, src)
+	return
+}
+
+// read the archive of the source or the nested one, the format is detected by the magic bytes if not specified,
+// the tar formats are streamed, and the zip file is cached into memory or local disk for random access
+func (this *Unzipper) readArchive(req ufop.UfopRequest, format string, archiveReader io.Reader,
+	archiveSize int64) (archive *unzipArchive, err error) {
+	srcReader := bufio.NewReaderSize(archiveReader, ARCHIVE_PEEK_BUF_SIZE)
+	if format == "" {
+		header, _ := srcReader.Peek(TAR_BLOCK_SIZE)
+		format = detectArchiveFormat(header)
+	}
+	if format != ARCHIVE_FORMAT_ZIP {
+		archive = &unzipArchive{
+			Format: format,
+			Stream: srcReader,
+			Size:   archiveSize,
+			reqId:  req.ReqId,
+		}
+		return
+	}
+
+	//when the size exceeds the threshold or is unknown, use disk cache
+	zipSrc := &ufop.UfopSource{
+		Body: ioutil.NopCloser(srcReader),
+		Size: archiveSize,
+	}
+	cachedSrc, cacheErr := zipSrc.Cache(this.maxZipFileLength)
+	if cacheErr != nil {
+		if cacheErr == ufop.ErrSourceTooLarge {
+			err = errArchiveTooLarge
+		} else {
+			err = cacheErr
+		}
+		return
+	}
+	archive = &unzipArchive{
+		Format:  format,
+		ZipData: cachedSrc,
+		Size:    cachedSrc.Size,
+		reqId:   req.ReqId,
+		closers: []io.Closer{cachedSrc},
+	}
+	return
+}
+
+// close the cache and the source of the archive
+func (this *unzipArchive) Close() {
+	for index := len(this.closers) - 1; index >= 0; index-- {
+		this.closers[index].Close()
+	}
+	if this.rangeReader != nil {
+		log.Infof("[%s] range requests sent: %d", this.reqId, this.rangeReader.Fetches())
+	}
+}
+
+// detect the archive format by the magic bytes in the header of the data, and zip is assumed when the format
+// is unknown
+func detectArchiveFormat(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, magicZip), bytes.HasPrefix(header, magicZipEmpty):
+		return ARCHIVE_FORMAT_ZIP
+	case bytes.HasPrefix(header, magicGzip):
+		return ARCHIVE_FORMAT_TAR_GZ
+	case bytes.HasPrefix(header, magicBzip2):
+		return ARCHIVE_FORMAT_TAR_BZ2
+	case bytes.HasPrefix(header, magicXz):
+		return ARCHIVE_FORMAT_TAR_XZ
+	case len(header) >= TAR_MAGIC_OFFSET+len(magicTar) &&
+		bytes.Equal(header[TAR_MAGIC_OFFSET:TAR_MAGIC_OFFSET+len(magicTar)], magicTar):
+		return ARCHIVE_FORMAT_TAR
+	}
+	return ARCHIVE_FORMAT_ZIP
+}
+
+// get the format of the nested archive by the extension of the file name, and the directory to extract it,
+// which is the file name without the extension, the format is empty when the file is not an archive
+func nestedArchiveFormat(fileName string) (format, dirName string) {
+	lowerName := strings.ToLower(fileName)
+	for _, nestedExt := range nestedArchiveExts {
+		if strings.HasSuffix(lowerName, nestedExt.ext) && len(fileName) > len(nestedExt.ext) &&
+			!strings.HasSuffix(fileName[:len(fileName)-len(nestedExt.ext)], "/") {
+			format = nestedExt.format
+			dirName = fileName[:len(fileName)-len(nestedExt.ext)] + "/"
+			return
+		}
+	}
+	return
+}
+
+// check the magic bytes of the nested archive, the zip format is not assumed here
+func matchArchiveFormat(format string, header []byte) bool {
+	if format == ARCHIVE_FORMAT_ZIP {
+		return bytes.HasPrefix(header, magicZip) || bytes.HasPrefix(header, magicZipEmpty)
+	}
+	return detectArchiveFormat(header) == format
+}
+
+// wrap the compressed tar stream with the decompressor of the format
+func newTarStreamReader(format string, srcReader io.Reader) (tarStream io.Reader, err error) {
+	switch format {
+	case ARCHIVE_FORMAT_TAR:
+		tarStream = srcReader
+	case ARCHIVE_FORMAT_TAR_GZ:
+		gzipReader, gzipErr := gzip.NewReader(srcReader)
+		if gzipErr != nil {
+			err = fmt.Errorf("invalid gzip data, %s", gzipErr.Error())
+			return
+		}
+		tarStream = gzipReader
+	case ARCHIVE_FORMAT_TAR_BZ2:
+		tarStream = bzip2.NewReader(srcReader)
+	case ARCHIVE_FORMAT_TAR_XZ:
+		xzReader, xzErr := xz.NewReader(srcReader)
+		if xzErr != nil {
+			err = fmt.Errorf("invalid xz data, %s", xzErr.Error())
+			return
+		}
+		tarStream = xzReader
+	default:
+		err = fmt.Errorf("unsupported archive format '%s'", format)
+	}
+	return
+}
+
+// archiveLimitReader fails the read when the data read exceeds the limit,
+// it is used to check the length of the streamed archive whose size is unknown
+type archiveLimitReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (this *archiveLimitReader) Read(p []byte) (n int, err error) {
+	if this.remaining < 0 {
+		err = errArchiveTooLarge
+		return
+	}
+	if int64(len(p)) > this.remaining+1 {
+		p = p[:this.remaining+1]
+	}
+	n, err = this.reader.Read(p)
+	this.remaining -= int64(n)
+	if this.remaining < 0 {
+		err = errArchiveTooLarge
+	}
+	return
+}
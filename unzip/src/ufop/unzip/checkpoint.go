@@ -0,0 +1,230 @@
+package unzip
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"ufop"
+
+	"github.com/qiniu/log"
+)
+
+// unzipCheckpoint 记录已经上传完成的文件，相同的命令和资源重新提交时跳过这些文件，从中断的位置继续解压，
+// 检查点文件每行一个 json 记录，第一行为资源的 ETag，之后每上传完成一个文件追加一行，
+// 重新提交的请求 ReqId 不同，所以检查点文件按照命令和去掉签名参数的资源 url 命名，
+// 使用时对检查点文件加排他锁，同时处理相同资源的其他任务不使用检查点
+type unzipCheckpoint struct {
+	path string
+
+	lock  sync.Mutex
+	fh    *os.File
+	files map[string]UnzipFile
+}
+
+type checkpointHeader struct {
+	ETag string `json:"etag"`
+}
+
+// the query parameters of the signed private urls, which change every time the url is signed, the qiniu private
+// urls are signed by 'e' and 'token', and the s3 presigned urls by the 'X-Amz-' ones or the v2 ones
+var checkpointSignParams = map[string]bool{
+	"e":              true,
+	"token":          true,
+	"expires":        true,
+	"signature":      true,
+	"awsaccesskeyid": true,
+}
+
+// the checkpoint is only used for the resource url, because the request body can not be identified, and not used
+// in the atomic mode, because the staged files are always rolled back when failed
+func (this *Unzipper) newCheckpoint(req ufop.UfopRequest, params UnzipParams) *unzipCheckpoint {
+	if req.Url == "" || params.Atomic || this.checkpointDir == "" {
+		return nil
+	}
+	return &unzipCheckpoint{
+		path: filepath.Join(this.checkpointDir,
+			fmt.Sprintf("unzip_checkpoint_%x", md5.Sum([]byte(req.Cmd+"\n"+unsignedUrl(req.Url))))),
+		files: make(map[string]UnzipFile),
+	}
+}
+
+// remove the signing parameters from the url, so the resubmitted job with the url signed again uses the same
+// checkpoint, the changed resource is still detected by the etag
+func unsignedUrl(rawUrl string) string {
+	resUrl, parseErr := url.Parse(rawUrl)
+	if parseErr != nil || resUrl.RawQuery == "" {
+		return rawUrl
+	}
+	params := make([]string, 0)
+	for _, param := range strings.Split(resUrl.RawQuery, "&") {
+		name := param
+		if index := strings.Index(param, "="); index >= 0 {
+			name = param[:index]
+		}
+		name = strings.ToLower(name)
+		if checkpointSignParams[name] || strings.HasPrefix(name, "x-amz-") {
+			continue
+		}
+		params = append(params, param)
+	}
+	resUrl.RawQuery = strings.Join(params, "&")
+	return resUrl.String()
+}
+
+// load the completed files when the etag is the same as the recorded one, otherwise start a new checkpoint,
+// the incomplete record left by the crash is truncated before appending, the file is locked exclusively until
+// closed, and the lock is released by the system when the process exits
+func (this *unzipCheckpoint) open(etag string) (err error) {
+	fh, openErr := os.OpenFile(this.path, os.O_RDWR|os.O_CREATE, 0644)
+	if openErr != nil {
+		err = fmt.Errorf("open checkpoint file failed, %s", openErr.Error())
+		return
+	}
+	if lockErr := syscall.Flock(int(fh.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); lockErr != nil {
+		fh.Close()
+		err = fmt.Errorf("checkpoint file is used by another job, %s", lockErr.Error())
+		return
+	}
+	//the file may be removed by the job completed before the lock is acquired
+	fileInfo, fStatErr := fh.Stat()
+	pathInfo, pStatErr := os.Stat(this.path)
+	if fStatErr != nil || pStatErr != nil || !os.SameFile(fileInfo, pathInfo) {
+		fh.Close()
+		err = errors.New("checkpoint file is removed by another job")
+		return
+	}
+
+	validLength := this.load(fh, etag)
+	if validLength == 0 {
+		headerData, _ := json.Marshal(checkpointHeader{ETag: etag})
+		headerData = append(headerData, '\n')
+		if _, wErr := fh.WriteAt(headerData, 0); wErr != nil {
+			fh.Close()
+			err = fmt.Errorf("write checkpoint file failed, %s", wErr.Error())
+			return
+		}
+		validLength = int64(len(headerData))
+	}
+	if tErr := fh.Truncate(validLength); tErr != nil {
+		fh.Close()
+		err = fmt.Errorf("truncate checkpoint file failed, %s", tErr.Error())
+		return
+	}
+	if _, sErr := fh.Seek(validLength, io.SeekStart); sErr != nil {
+		fh.Close()
+		err = fmt.Errorf("seek checkpoint file failed, %s", sErr.Error())
+		return
+	}
+	this.fh = fh
+	return
+}
+
+// read the records and return the length of the complete ones, 0 when the etag does not match
+func (this *unzipCheckpoint) load(fh *os.File, etag string) (validLength int64) {
+	lineReader := bufio.NewReader(fh)
+	var header checkpointHeader
+	for lineNo := 0; ; lineNo++ {
+		line, readErr := lineReader.ReadBytes('\n')
+		if readErr != nil {
+			//the last line without the line break is incomplete
+			break
+		}
+
+		if lineNo == 0 {
+			if json.Unmarshal(line, &header) != nil || header.ETag != etag {
+				return 0
+			}
+		} else {
+			var unzipFile UnzipFile
+			if json.Unmarshal(bytes.TrimSpace(line), &unzipFile) != nil {
+				break
+			}
+			this.files[unzipFile.Key] = unzipFile
+		}
+		validLength += int64(len(line))
+	}
+	return
+}
+
+// get the file completed before, the size and the modified time must be the same as the file in the archive
+func (this *unzipCheckpoint) completed(fileKey string, fileSize int64, mtime string) (unzipFile UnzipFile,
+	ok bool) {
+	unzipFile, ok = this.files[fileKey]
+	if ok && (unzipFile.Size != fileSize || unzipFile.Mtime != mtime) {
+		ok = false
+	}
+	return
+}
+
+// append the uploaded file to the checkpoint, the job goes on when failed to record, and the file will be
+// uploaded again when resumed
+func (this *unzipCheckpoint) record(reqId string, unzipFile UnzipFile) {
+	unzipFile.Retries = 0
+	lineData, _ := json.Marshal(unzipFile)
+	lineData = append(lineData, '\n')
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.fh == nil {
+		return
+	}
+	if _, wErr := this.fh.Write(lineData); wErr != nil {
+		log.Warnf("[%s] write checkpoint of file %s failed, %s", reqId, unzipFile.Key, wErr.Error())
+	}
+}
+
+// close the checkpoint file, and remove it when the job is completed, the file is removed before the lock is
+// released, so no other job can lock the file removed
+func (this *unzipCheckpoint) close(completed bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.fh == nil {
+		return
+	}
+	if completed {
+		os.Remove(this.path)
+	}
+	this.fh.Close()
+	this.fh = nil
+}
+
+// resume the uploads from the checkpoint of the resource, the checkpoint is not used when the resource has no
+// etag to tell whether it is changed, or the checkpoint file can not be opened
+func (this *unzipUploader) resume(etag string) {
+	if this.checkpoint == nil {
+		return
+	}
+	reqId := this.req.ReqId
+	if etag == "" {
+		log.Infof("[%s] resource has no etag, checkpoint is not used", reqId)
+		this.checkpoint = nil
+		return
+	}
+	if openErr := this.checkpoint.open(etag); openErr != nil {
+		log.Warnf("[%s] checkpoint is not used, %s", reqId, openErr.Error())
+		this.checkpoint = nil
+		return
+	}
+	if len(this.checkpoint.files) > 0 {
+		log.Infof("[%s] resume from checkpoint, completed files: %d", reqId, len(this.checkpoint.files))
+	}
+}
+
+// close the checkpoint after all the uploads are done, it is kept to resume the failed files unless all the
+// files are uploaded
+func (this *unzipUploader) closeCheckpoint(completed bool) {
+	if this.checkpoint == nil {
+		return
+	}
+	this.checkpoint.close(completed)
+}
@@ -0,0 +1,130 @@
+package unzip
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"ufop"
+)
+
+func TestUnsignedUrl(t *testing.T) {
+	cases := []struct {
+		rawUrl   string
+		unsigned string
+	}{
+		{"http://a.com/x.zip", "http://a.com/x.zip"},
+		{"http://a.com/x.zip?e=1500000000&token=ak:sign", "http://a.com/x.zip"},
+		{"http://a.com/x.zip?v=2&e=1500000000&token=ak:sign", "http://a.com/x.zip?v=2"},
+		{"https://b.s3.amazonaws.com/x.zip?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Signature=abc&part=1",
+			"https://b.s3.amazonaws.com/x.zip?part=1"},
+		{"https://b.s3.amazonaws.com/x.zip?AWSAccessKeyId=ak&Expires=1&Signature=abc",
+			"https://b.s3.amazonaws.com/x.zip"},
+		{"http://a.com/x.zip?token", "http://a.com/x.zip"},
+	}
+	for _, c := range cases {
+		if unsigned := unsignedUrl(c.rawUrl); unsigned != c.unsigned {
+			t.Errorf("unsignedUrl(%q) = %q, want %q", c.rawUrl, unsigned, c.unsigned)
+		}
+	}
+}
+
+func TestCheckpointResume(t *testing.T) {
+	checkpointDir, _ := ioutil.TempDir("", "unzip_checkpoint")
+	defer os.RemoveAll(checkpointDir)
+	unzipper := &Unzipper{checkpointDir: checkpointDir}
+	req := ufop.UfopRequest{
+		Cmd: "unzip/bucket/YQ==",
+		Url: "http://a.com/x.zip?e=1&token=ak:sign1",
+	}
+	newCheckpoint := func(resUrl string) *unzipCheckpoint {
+		req.Url = resUrl
+		return unzipper.newCheckpoint(req, UnzipParams{})
+	}
+
+	checkpoint := newCheckpoint(req.Url)
+	if err := checkpoint.open("etag1"); err != nil {
+		t.Fatal(err)
+	}
+	checkpoint.record("r1", UnzipFile{Key: "a.txt", Size: 1, Mtime: "m1", Retries: 2})
+	checkpoint.record("r1", UnzipFile{Key: "b.txt", Size: 2, Mtime: "m2"})
+	checkpoint.close(false)
+
+	//the record left incomplete by the crash is ignored and truncated
+	fh, _ := os.OpenFile(checkpoint.path, os.O_WRONLY|os.O_APPEND, 0644)
+	fh.WriteString(`{"key":"c.txt","si`)
+	fh.Close()
+
+	//the url signed again uses the same checkpoint
+	checkpoint = newCheckpoint("http://a.com/x.zip?e=2&token=ak:sign2")
+	if err := checkpoint.open("etag1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(checkpoint.files) != 2 {
+		t.Fatalf("completed files = %v, want 2 files", checkpoint.files)
+	}
+	if unzipFile, ok := checkpoint.completed("a.txt", 1, "m1"); !ok || unzipFile.Retries != 0 {
+		t.Errorf("a.txt completed = %v, %v", unzipFile, ok)
+	}
+	if _, ok := checkpoint.completed("b.txt", 3, "m2"); ok {
+		t.Error("b.txt with another size should not be completed")
+	}
+	if _, ok := checkpoint.completed("b.txt", 2, "m3"); ok {
+		t.Error("b.txt with another modified time should not be completed")
+	}
+	checkpoint.record("r2", UnzipFile{Key: "c.txt", Size: 3, Mtime: "m3"})
+	checkpoint.close(false)
+
+	checkpoint = newCheckpoint(req.Url)
+	if err := checkpoint.open("etag1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := checkpoint.completed("c.txt", 3, "m3"); !ok || len(checkpoint.files) != 3 {
+		t.Fatalf("completed files = %v, want 3 files", checkpoint.files)
+	}
+	checkpoint.close(false)
+
+	//the changed resource starts a new checkpoint
+	checkpoint = newCheckpoint(req.Url)
+	if err := checkpoint.open("etag2"); err != nil {
+		t.Fatal(err)
+	}
+	if len(checkpoint.files) != 0 {
+		t.Fatalf("completed files of the changed resource = %v", checkpoint.files)
+	}
+	checkpoint.close(true)
+	if _, err := os.Stat(checkpoint.path); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint file is not removed when completed, %v", err)
+	}
+}
+
+func TestCheckpointLock(t *testing.T) {
+	checkpointDir, _ := ioutil.TempDir("", "unzip_checkpoint")
+	defer os.RemoveAll(checkpointDir)
+	unzipper := &Unzipper{checkpointDir: checkpointDir}
+	req := ufop.UfopRequest{
+		Cmd: "unzip/bucket/YQ==",
+		Url: "http://a.com/x.zip",
+	}
+
+	checkpoint := unzipper.newCheckpoint(req, UnzipParams{})
+	if err := checkpoint.open("etag"); err != nil {
+		t.Fatal(err)
+	}
+	other := unzipper.newCheckpoint(req, UnzipParams{})
+	if err := other.open("etag"); err == nil {
+		t.Fatal("the checkpoint locked by another job should not be opened")
+	}
+	checkpoint.close(false)
+	if err := other.open("etag"); err != nil {
+		t.Fatal(err)
+	}
+	other.close(true)
+
+	//no checkpoint for the request body, or in the atomic mode
+	if unzipper.newCheckpoint(ufop.UfopRequest{Cmd: req.Cmd}, UnzipParams{}) != nil {
+		t.Error("checkpoint should not be used for the request body")
+	}
+	if unzipper.newCheckpoint(req, UnzipParams{Atomic: true}) != nil {
+		t.Error("checkpoint should not be used in the atomic mode")
+	}
+}
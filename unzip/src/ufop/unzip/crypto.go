@@ -0,0 +1,377 @@
+package unzip
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	//the general purpose flag bits of the encryption
+	ZIP_FLAG_ENCRYPTED        = 0x1
+	ZIP_FLAG_DATA_DESCRIPTOR  = 0x8
+	ZIP_FLAG_STRONG_ENCRYPTED = 0x40
+)
+
+const (
+	//the compression method and the extra field id of the winzip aes encryption
+	ZIP_METHOD_WINZIP_AES   = 99
+	ZIP_EXTRA_WINZIP_AES    = 0x9901
+	WINZIP_AES_VERSION_AE2  = 2
+	WINZIP_AES_ITERATIONS   = 1000
+	WINZIP_AES_VERIFIER_LEN = 2
+	WINZIP_AES_AUTH_LEN     = 10
+	ZIP_CRYPTO_HEADER_LEN   = 12
+)
+
+var (
+	errZipPasswordRequired = errors.New("zip file is encrypted, password required")
+	errZipWrongPassword    = errors.New("wrong zip password")
+	errZipUnsupportedCrypt = errors.New("unsupported zip encryption method")
+	errZipAuthFailed       = errors.New("zip file authentication failed, wrong password or corrupted data")
+)
+
+// winzipAesExtra 为 WinZip AES 加密文件的扩展字段，Strength 为 1、2、3 分别表示 AES-128、AES-192、AES-256，
+// Method 为加密前数据的实际压缩方式
+type winzipAesExtra struct {
+	Version  uint16
+	Strength byte
+	Method   uint16
+}
+
+// the key length of the aes strength, 0 for unknown strength
+func (this *winzipAesExtra) keyLen() int {
+	switch this.Strength {
+	case 1:
+		return 16
+	case 2:
+		return 24
+	case 3:
+		return 32
+	}
+	return 0
+}
+
+// the salt length is half of the key length
+func (this *winzipAesExtra) saltLen() int {
+	return this.keyLen() / 2
+}
+
+func isZipFileEncrypted(zipFile *zip.File) bool {
+	return zipFile.Flags&ZIP_FLAG_ENCRYPTED != 0
+}
+
+// parse the winzip aes extra field, return nil if not found
+func parseWinzipAesExtra(extra []byte) *winzipAesExtra {
+	for len(extra) >= 4 {
+		tag := binary.LittleEndian.Uint16(extra[0:2])
+		size := int(binary.LittleEndian.Uint16(extra[2:4]))
+		extra = extra[4:]
+		if size > len(extra) {
+			break
+		}
+		if tag == ZIP_EXTRA_WINZIP_AES && size >= 7 && string(extra[2:4]) == "AE" {
+			return &winzipAesExtra{
+				Version:  binary.LittleEndian.Uint16(extra[0:2]),
+				Strength: extra[4],
+				Method:   binary.LittleEndian.Uint16(extra[5:7]),
+			}
+		}
+		extra = extra[size:]
+	}
+	return nil
+}
+
+// check whether the encrypted zip file item can be decrypted, the password itself is checked when opened
+func checkZipFileEncryption(zipFile *zip.File, password string) (err error) {
+	if !isZipFileEncrypted(zipFile) {
+		return
+	}
+	if password == "" {
+		err = errZipPasswordRequired
+		return
+	}
+	err = checkZipEncryptionMethod(zipFile)
+	return
+}
+
+// check whether the encryption method and the compression method of the encrypted zip file item are supported
+func checkZipEncryptionMethod(zipFile *zip.File) (err error) {
+	if zipFile.Flags&ZIP_FLAG_STRONG_ENCRYPTED != 0 {
+		err = errZipUnsupportedCrypt
+		return
+	}
+
+	method := zipFile.Method
+	if method == ZIP_METHOD_WINZIP_AES {
+		aesExtra := parseWinzipAesExtra(zipFile.Extra)
+		if aesExtra == nil || aesExtra.keyLen() == 0 {
+			err = errZipUnsupportedCrypt
+			return
+		}
+		method = aesExtra.Method
+	}
+	if method != zip.Store && method != zip.Deflate {
+		err = errZipUnsupportedCrypt
+		return
+	}
+	return
+}
+
+// open the zip file item, the encrypted one is decrypted by the password, traditional pkware encryption
+// and winzip aes encryption are supported
+func openZipFile(zipFile *zip.File, password string) (reader io.ReadCloser, err error) {
+	if !isZipFileEncrypted(zipFile) {
+		return zipFile.Open()
+	}
+	if err = checkZipFileEncryption(zipFile, password); err != nil {
+		return
+	}
+
+	rawReader, rawErr := zipFile.OpenRaw()
+	if rawErr != nil {
+		err = rawErr
+		return
+	}
+
+	var decrypted io.Reader
+	method := zipFile.Method
+	checkCrc := true
+	if method == ZIP_METHOD_WINZIP_AES {
+		aesExtra := parseWinzipAesExtra(zipFile.Extra)
+		decrypted, err = newWinzipAesReader(rawReader, int64(zipFile.CompressedSize64), aesExtra, password)
+		method = aesExtra.Method
+		//the crc32 is not stored in AE-2
+		checkCrc = aesExtra.Version != WINZIP_AES_VERSION_AE2
+	} else {
+		decrypted, err = newZipCryptoReader(rawReader, int64(zipFile.CompressedSize64), zipFile, password)
+	}
+	if err != nil {
+		return
+	}
+
+	var decompressed io.ReadCloser
+	if method == zip.Deflate {
+		decompressed = flate.NewReader(decrypted)
+	} else {
+		decompressed = ioutil.NopCloser(decrypted)
+	}
+	reader = &zipChecksumReader{
+		reader:    decompressed,
+		decrypted: decrypted,
+		hash:      crc32.NewIEEE(),
+		checkCrc:  checkCrc,
+		crc32:     zipFile.CRC32,
+		size:      zipFile.UncompressedSize64,
+		zipCrypto: zipFile.Method != ZIP_METHOD_WINZIP_AES,
+	}
+	return
+}
+
+// zipCryptoReader decrypts the data encrypted by the traditional pkware encryption
+type zipCryptoReader struct {
+	reader io.Reader
+	keys   [3]uint32
+}
+
+func newZipCryptoReader(rawReader io.Reader, compressedSize int64, zipFile *zip.File,
+	password string) (reader *zipCryptoReader, err error) {
+	if compressedSize < ZIP_CRYPTO_HEADER_LEN {
+		err = zip.ErrFormat
+		return
+	}
+	reader = &zipCryptoReader{
+		reader: io.LimitReader(rawReader, compressedSize-ZIP_CRYPTO_HEADER_LEN),
+		keys:   [3]uint32{0x12345678, 0x23456789, 0x34567890},
+	}
+	for i := 0; i < len(password); i++ {
+		reader.update(password[i])
+	}
+
+	header := make([]byte, ZIP_CRYPTO_HEADER_LEN)
+	if _, readErr := io.ReadFull(rawReader, header); readErr != nil {
+		err = readErr
+		return
+	}
+	reader.decrypt(header)
+	//the last byte of the header is the high byte of the crc32, or of the modified time when the crc32 is
+	//stored in the data descriptor
+	checkByte := header[ZIP_CRYPTO_HEADER_LEN-1]
+	if checkByte != byte(zipFile.CRC32>>24) &&
+		!(zipFile.Flags&ZIP_FLAG_DATA_DESCRIPTOR != 0 && checkByte == byte(zipFile.ModifiedTime>>8)) {
+		err = errZipWrongPassword
+		return
+	}
+	return
+}
+
+func (this *zipCryptoReader) update(b byte) {
+	this.keys[0] = crc32Update(this.keys[0], b)
+	this.keys[1] = (this.keys[1]+this.keys[0]&0xff)*134775813 + 1
+	this.keys[2] = crc32Update(this.keys[2], byte(this.keys[1]>>24))
+}
+
+func (this *zipCryptoReader) decrypt(p []byte) {
+	for i := range p {
+		temp := uint16(this.keys[2]) | 2
+		p[i] ^= byte((uint32(temp) * uint32(temp^1)) >> 8)
+		this.update(p[i])
+	}
+}
+
+func (this *zipCryptoReader) Read(p []byte) (n int, err error) {
+	n, err = this.reader.Read(p)
+	this.decrypt(p[:n])
+	return
+}
+
+func crc32Update(crc uint32, b byte) uint32 {
+	return crc32.IEEETable[byte(crc)^b] ^ (crc >> 8)
+}
+
+// winzipAesReader decrypts the data encrypted by the winzip aes encryption, the data is authenticated by
+// the hmac-sha1 code at the end of the data
+type winzipAesReader struct {
+	rawReader io.Reader
+	reader    io.Reader
+	block     cipher.Block
+	counter   [aes.BlockSize]byte
+	stream    [aes.BlockSize]byte
+	streamPos int
+	mac       hash.Hash
+	//the result of the authentication, set when reaching the end
+	authErr error
+}
+
+func newWinzipAesReader(rawReader io.Reader, compressedSize int64, aesExtra *winzipAesExtra,
+	password string) (reader *winzipAesReader, err error) {
+	keyLen := aesExtra.keyLen()
+	saltLen := aesExtra.saltLen()
+	dataLen := compressedSize - int64(saltLen+WINZIP_AES_VERIFIER_LEN+WINZIP_AES_AUTH_LEN)
+	if dataLen < 0 {
+		err = zip.ErrFormat
+		return
+	}
+
+	header := make([]byte, saltLen+WINZIP_AES_VERIFIER_LEN)
+	if _, readErr := io.ReadFull(rawReader, header); readErr != nil {
+		err = readErr
+		return
+	}
+	salt := header[:saltLen]
+	verifier := header[saltLen:]
+	keys := pbkdf2.Key([]byte(password), salt, WINZIP_AES_ITERATIONS, 2*keyLen+WINZIP_AES_VERIFIER_LEN, sha1.New)
+	if !bytes.Equal(keys[2*keyLen:], verifier) {
+		err = errZipWrongPassword
+		return
+	}
+
+	block, blockErr := aes.NewCipher(keys[:keyLen])
+	if blockErr != nil {
+		err = blockErr
+		return
+	}
+	reader = &winzipAesReader{
+		rawReader: rawReader,
+		reader:    io.LimitReader(rawReader, dataLen),
+		block:     block,
+		streamPos: aes.BlockSize,
+		mac:       hmac.New(sha1.New, keys[keyLen:2*keyLen]),
+	}
+	return
+}
+
+func (this *winzipAesReader) Read(p []byte) (n int, err error) {
+	if this.authErr != nil {
+		err = this.authErr
+		return
+	}
+	n, err = this.reader.Read(p)
+	this.mac.Write(p[:n])
+	for i := 0; i < n; i++ {
+		if this.streamPos == aes.BlockSize {
+			//the counter is little endian and starts from 1
+			for j := range this.counter {
+				this.counter[j] += 1
+				if this.counter[j] != 0 {
+					break
+				}
+			}
+			this.block.Encrypt(this.stream[:], this.counter[:])
+			this.streamPos = 0
+		}
+		p[i] ^= this.stream[this.streamPos]
+		this.streamPos += 1
+	}
+
+	if err == io.EOF {
+		authCode := make([]byte, WINZIP_AES_AUTH_LEN)
+		if _, readErr := io.ReadFull(this.rawReader, authCode); readErr != nil {
+			err = readErr
+		} else if !hmac.Equal(this.mac.Sum(nil)[:WINZIP_AES_AUTH_LEN], authCode) {
+			err = errZipAuthFailed
+		}
+		this.authErr = err
+	}
+	return
+}
+
+// zipChecksumReader checks the size and the crc32 of the decompressed data when reaching the end, and the
+// rest of the decrypted data is drained to check the authentication code
+type zipChecksumReader struct {
+	reader    io.ReadCloser
+	decrypted io.Reader
+	hash      hash.Hash32
+	checkCrc  bool
+	crc32     uint32
+	size      uint64
+	nread     uint64
+	zipCrypto bool
+}
+
+func (this *zipChecksumReader) Read(p []byte) (n int, err error) {
+	n, err = this.reader.Read(p)
+	this.hash.Write(p[:n])
+	this.nread += uint64(n)
+	//fail as soon as the data exceeds the declared size, not after the oversized data is read to the end
+	if this.nread > this.size {
+		err = zip.ErrFormat
+		return
+	}
+	if err == nil {
+		return
+	}
+	if err == io.EOF {
+		if _, drainErr := io.Copy(ioutil.Discard, this.decrypted); drainErr != nil {
+			err = drainErr
+		} else if this.nread != this.size {
+			err = io.ErrUnexpectedEOF
+		} else if this.checkCrc && this.hash.Sum32() != this.crc32 {
+			err = zip.ErrChecksum
+		}
+	}
+	//the corrupted data decrypted by the traditional pkware encryption mostly means a wrong password,
+	//because the password is only checked by one byte in the header
+	if this.zipCrypto && err != io.EOF {
+		if _, ok := err.(flate.CorruptInputError); ok || err == zip.ErrChecksum {
+			err = errZipWrongPassword
+		}
+	}
+	return
+}
+
+func (this *zipChecksumReader) Close() error {
+	return this.reader.Close()
+}
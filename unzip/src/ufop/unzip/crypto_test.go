@@ -0,0 +1,174 @@
+package unzip
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// encrypt the data by the traditional pkware encryption, the header is checked by the high byte of the crc32
+func zipCryptoEncrypt(password string, crc uint32, data []byte) []byte {
+	keys := &zipCryptoReader{
+		keys: [3]uint32{0x12345678, 0x23456789, 0x34567890},
+	}
+	for i := 0; i < len(password); i++ {
+		keys.update(password[i])
+	}
+	plain := make([]byte, ZIP_CRYPTO_HEADER_LEN, ZIP_CRYPTO_HEADER_LEN+len(data))
+	plain[ZIP_CRYPTO_HEADER_LEN-1] = byte(crc >> 24)
+	plain = append(plain, data...)
+	encrypted := make([]byte, len(plain))
+	for i, b := range plain {
+		temp := uint16(keys.keys[2]) | 2
+		encrypted[i] = b ^ byte((uint32(temp)*uint32(temp^1))>>8)
+		keys.update(b)
+	}
+	return encrypted
+}
+
+// encrypt the data by the winzip aes-256 encryption, the result is the salt, the password verifier, the
+// encrypted data and the authentication code
+func winzipAesEncrypt(password string, data []byte) []byte {
+	const keyLen = 32
+	salt := bytes.Repeat([]byte{0x5a}, keyLen/2)
+	keys := pbkdf2.Key([]byte(password), salt, WINZIP_AES_ITERATIONS, 2*keyLen+WINZIP_AES_VERIFIER_LEN, sha1.New)
+	block, _ := aes.NewCipher(keys[:keyLen])
+	var counter, stream [aes.BlockSize]byte
+	encrypted := make([]byte, len(data))
+	for i := range data {
+		if i%aes.BlockSize == 0 {
+			for j := range counter {
+				counter[j] += 1
+				if counter[j] != 0 {
+					break
+				}
+			}
+			block.Encrypt(stream[:], counter[:])
+		}
+		encrypted[i] = data[i] ^ stream[i%aes.BlockSize]
+	}
+	mac := hmac.New(sha1.New, keys[keyLen:2*keyLen])
+	mac.Write(encrypted)
+
+	raw := append(append([]byte{}, salt...), keys[2*keyLen:]...)
+	raw = append(raw, encrypted...)
+	return append(raw, mac.Sum(nil)[:WINZIP_AES_AUTH_LEN]...)
+}
+
+// create the zip with one encrypted file, the data is deflated before encrypted when deflate is set
+func encryptedZip(t *testing.T, aesEncrypted, deflate bool, password string, data []byte) *zip.File {
+	method := zip.Store
+	compressed := data
+	if deflate {
+		method = zip.Deflate
+		var buf bytes.Buffer
+		flateWriter, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+		flateWriter.Write(data)
+		flateWriter.Close()
+		compressed = buf.Bytes()
+	}
+
+	fileHeader := &zip.FileHeader{
+		Name:               "secret.txt",
+		Flags:              ZIP_FLAG_ENCRYPTED,
+		Method:             method,
+		UncompressedSize64: uint64(len(data)),
+	}
+	var raw []byte
+	if aesEncrypted {
+		//AE-2 does not store the crc32
+		extra := make([]byte, 11)
+		binary.LittleEndian.PutUint16(extra[0:2], ZIP_EXTRA_WINZIP_AES)
+		binary.LittleEndian.PutUint16(extra[2:4], 7)
+		binary.LittleEndian.PutUint16(extra[4:6], WINZIP_AES_VERSION_AE2)
+		copy(extra[6:8], "AE")
+		extra[8] = 3
+		binary.LittleEndian.PutUint16(extra[9:11], method)
+		fileHeader.Method = ZIP_METHOD_WINZIP_AES
+		fileHeader.Extra = extra
+		raw = winzipAesEncrypt(password, compressed)
+	} else {
+		fileHeader.CRC32 = crc32.ChecksumIEEE(data)
+		raw = zipCryptoEncrypt(password, fileHeader.CRC32, compressed)
+	}
+	fileHeader.CompressedSize64 = uint64(len(raw))
+
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	fileWriter, err := zipWriter.CreateRaw(fileHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileWriter.Write(raw)
+	zipWriter.Close()
+
+	zipReader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zipReader.File[0]
+}
+
+// open and read the zip file item, the error is returned by either of them
+func readZipFile(zipFile *zip.File, password string) (data []byte, err error) {
+	reader, err := openZipFile(zipFile, password)
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+func TestOpenEncryptedZipFile(t *testing.T) {
+	data := bytes.Repeat([]byte("encrypted zip data, "), 1000)
+	cases := []struct {
+		name         string
+		aesEncrypted bool
+		deflate      bool
+	}{
+		{"zipcrypto store", false, false},
+		{"zipcrypto deflate", false, true},
+		{"ae-2 store", true, false},
+		{"ae-2 deflate", true, true},
+	}
+	for _, c := range cases {
+		zipFile := encryptedZip(t, c.aesEncrypted, c.deflate, "secret", data)
+		if unzipped, err := readZipFile(zipFile, "secret"); err != nil || !bytes.Equal(unzipped, data) {
+			t.Errorf("%s: read with the password, error = %v, data equal = %v", c.name, err,
+				bytes.Equal(unzipped, data))
+		}
+		if _, err := readZipFile(zipFile, "wrong"); err != errZipWrongPassword {
+			t.Errorf("%s: read with the wrong password, error = %v, want %v", c.name, err, errZipWrongPassword)
+		}
+		if _, err := readZipFile(zipFile, ""); err != errZipPasswordRequired {
+			t.Errorf("%s: read without password, error = %v, want %v", c.name, err, errZipPasswordRequired)
+		}
+	}
+}
+
+func TestOpenTamperedZipFile(t *testing.T) {
+	data := bytes.Repeat([]byte("authenticated data, "), 100)
+
+	//the aes encrypted data is authenticated by the hmac
+	aesFile := encryptedZip(t, true, false, "secret", data)
+	aesFile.CompressedSize64 -= 1
+	if _, err := readZipFile(aesFile, "secret"); err != errZipAuthFailed {
+		t.Errorf("tampered aes data error = %v, want %v", err, errZipAuthFailed)
+	}
+
+	//the size is checked even if the crc32 is not stored in AE-2
+	aesFile = encryptedZip(t, true, false, "secret", data)
+	aesFile.UncompressedSize64 -= 1
+	if _, err := readZipFile(aesFile, "secret"); err != zip.ErrFormat {
+		t.Errorf("oversized aes data error = %v, want %v", err, zip.ErrFormat)
+	}
+}
@@ -0,0 +1,258 @@
+package unzip
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"ufop"
+	"ufop/utils"
+
+	"github.com/qiniu/log"
+)
+
+const (
+	UNZIP_ENTRY_CMD_PREFIX = "unzip/entry/"
+)
+
+var errEntryNotFound = errors.New("entry not found in the archive")
+
+/*
+
+unzip/entry/<encoded name>/charset/<encoded charset>/format/<[zip|tar|tar.gz|tgz|tar.bz2|tbz2|tar.xz|txz]>/password/<encoded password>
+
+*/
+func (this *Unzipper) parseEntry(cmd string) (params UnzipParams, err error) {
+	pattern := "^unzip/entry/[0-9a-zA-Z-_=]+(/charset/[0-9a-zA-Z-_=]+){0,1}" +
+		"(/format/(zip|tar|tgz|tbz2|txz|tar\\.gz|tar\\.bz2|tar\\.xz)){0,1}(/password/[0-9a-zA-Z-_=]+){0,1}$"
+	matched, _ := regexp.MatchString(pattern, cmd)
+	if !matched {
+		err = errors.New("invalid unzip entry command format")
+		return
+	}
+
+	entryName, decodeErr := utils.GetParamDecoded(cmd, "entry/[0-9a-zA-Z-_=]+", "entry")
+	if decodeErr != nil {
+		err = errors.New("invalid unzip parameter 'entry'")
+		return
+	}
+	//the name is matched with the normalized names in the archive
+	params.Entry, err = sanitizeFileName(entryName, this.maxDirDepth)
+	if err != nil {
+		err = fmt.Errorf("invalid unzip parameter 'entry', %s", err.Error())
+		return
+	}
+	if err = parseArchiveParams(cmd, &params); err != nil {
+		return
+	}
+	params.Password, decodeErr = utils.GetParamDecoded(cmd, "password/[0-9a-zA-Z-_=]+", "password")
+	if decodeErr != nil {
+		err = errors.New("invalid unzip parameter 'password'")
+		return
+	}
+	return
+}
+
+// extract the single entry and return it as the octet result, so it can be saved by saveas, the large remote
+// zip file is read by range requests, and only the central directory and the entry are fetched
+func (this *Unzipper) entry(req ufop.UfopRequest, ufopBody io.ReadCloser) (result interface{}, resultType int,
+	contentType string, err error) {
+	params, pErr := this.parseEntry(req.Cmd)
+	if pErr != nil {
+		err = pErr
+		return
+	}
+
+	archive, openErr := this.openArchive(req, params, ufopBody)
+	if openErr != nil {
+		err = openErr
+		return
+	}
+	defer archive.Close()
+
+	log.Infof("[%s] archive format: %s", req.ReqId, archive.Format)
+	guard := this.newGuard()
+	if archive.ZipData == nil {
+		result, resultType, contentType, err = this.extractTarEntry(req, params, archive.Format, archive.Stream, guard)
+	} else {
+		result, resultType, contentType, err = this.extractZipEntry(req, params, archive.ZipData, archive.Size, guard)
+	}
+	return
+}
+
+func (this *Unzipper) extractZipEntry(req ufop.UfopRequest, params UnzipParams, zipData io.ReaderAt, zipSize int64,
+	guard *unzipGuard) (result interface{}, resultType int, contentType string, err error) {
+	zipReader, zipErr := zip.NewReader(zipData, zipSize)
+	if zipErr != nil {
+		err = fmt.Errorf("invalid zip file, %s", zipErr.Error())
+		return
+	}
+
+	charset := params.Charset
+	if charset == "" {
+		charset = detectFileNameCharset(zipReader.File)
+	}
+	var entryFile *zip.File
+	for _, zipFile := range zipReader.File {
+		if zipFile.FileInfo().IsDir() {
+			continue
+		}
+		fileName, nErr := decodeFileName(zipFile, charset)
+		if nErr != nil {
+			continue
+		}
+		if safeName, sErr := sanitizeFileName(fileName, this.maxDirDepth); sErr == nil && safeName == params.Entry {
+			entryFile = zipFile
+			break
+		}
+	}
+	if entryFile == nil {
+		err = errEntryNotFound
+		return
+	}
+
+	if int64(entryFile.UncompressedSize64) > this.maxFileLength {
+		err = errFileTooLarge
+		return
+	}
+	if cErr := checkZipFileEncryption(entryFile, params.Password); cErr != nil {
+		err = cErr
+		return
+	}
+	zipFileReader, openErr := openZipFile(entryFile, params.Password)
+	if openErr != nil {
+		if openErr == errZipWrongPassword {
+			err = openErr
+		} else {
+			err = fmt.Errorf("open zip file content failed, %s", openErr.Error())
+		}
+		return
+	}
+	defer zipFileReader.Close()
+
+	fileReader := guard.reader(zipFileReader, int64(entryFile.CompressedSize64))
+	result, resultType, contentType, err = this.readEntry(req, params.Entry, fileReader,
+		int64(entryFile.UncompressedSize64))
+	return
+}
+
+// the tar file is read until the entry is found, the rest of the archive is not read
+func (this *Unzipper) extractTarEntry(req ufop.UfopRequest, params UnzipParams, format string, srcReader io.Reader,
+	guard *unzipGuard) (result interface{}, resultType int, contentType string, err error) {
+	limitReader := &archiveLimitReader{
+		reader:    srcReader,
+		remaining: this.maxZipFileLength,
+	}
+	tarStream, tErr := newTarStreamReader(format, limitReader)
+	if tErr != nil {
+		if limitReader.remaining < 0 {
+			err = errArchiveTooLarge
+		} else {
+			err = tErr
+		}
+		return
+	}
+
+	tarReader := tar.NewReader(tarStream)
+	for {
+		//stop when the job is cancelled
+		if jErr := req.Job.Err(); jErr != nil {
+			err = jErr
+			return
+		}
+
+		tarHeader, hErr := tarReader.Next()
+		if hErr == io.EOF {
+			err = errEntryNotFound
+			return
+		}
+		if hErr != nil {
+			if limitReader.remaining < 0 {
+				err = errArchiveTooLarge
+			} else {
+				err = fmt.Errorf("invalid tar file, %s", hErr.Error())
+			}
+			return
+		}
+		if tarHeader.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		fileName, nErr := decodeTarFileName(tarHeader, params.Charset)
+		if nErr != nil {
+			continue
+		}
+		if safeName, sErr := sanitizeFileName(fileName, this.maxDirDepth); sErr != nil || safeName != params.Entry {
+			continue
+		}
+
+		if tarHeader.Size > this.maxFileLength {
+			err = errFileTooLarge
+			return
+		}
+		sourceRead := func() int64 {
+			return this.maxZipFileLength - limitReader.remaining
+		}
+		fileReader := guard.stream(sourceRead).reader(tarReader, -1)
+		result, resultType, contentType, err = this.readEntry(req, params.Entry, fileReader, tarHeader.Size)
+		if err != nil && limitReader.remaining < 0 {
+			err = errArchiveTooLarge
+		}
+		return
+	}
+}
+
+// read the entry into memory, or into a local file when it is large, the local file is removed by the server
+// after the result is written, the content type is detected by the name and the header of the entry
+func (this *Unzipper) readEntry(req ufop.UfopRequest, entryName string, fileReader io.Reader, fileSize int64) (
+	result interface{}, resultType int, contentType string, err error) {
+	req.Job.SetPhase(ufop.JOB_PHASE_EXTRACTING)
+	entryReader := req.Job.Reader(fileReader)
+	var header []byte
+	if fileSize <= UNZIP_CACHE_FILE_ITEM_THRESHOLD {
+		entryData, readErr := ioutil.ReadAll(entryReader)
+		if readErr != nil {
+			if isGuardError(readErr) {
+				err = readErr
+			} else {
+				err = fmt.Errorf("unzip the file content failed, %s", readErr.Error())
+			}
+			return
+		}
+		header = entryData
+		result = entryData
+		resultType = ufop.RESULT_TYPE_OCTET_BYTES
+	} else {
+		entryFh, openErr := ioutil.TempFile("", "unzip_entry_")
+		if openErr != nil {
+			err = fmt.Errorf("open local entry file failed, %s", openErr.Error())
+			return
+		}
+		defer entryFh.Close()
+
+		digest := newFileDigest(false)
+		_, cpErr := io.Copy(entryFh, io.TeeReader(entryReader, digest))
+		if cpErr != nil {
+			os.Remove(entryFh.Name())
+			if isGuardError(cpErr) {
+				err = cpErr
+			} else {
+				err = fmt.Errorf("write local entry file failed, %s", cpErr.Error())
+			}
+			return
+		}
+		header = digest.header
+		result = entryFh.Name()
+		resultType = ufop.RESULT_TYPE_OCTET_FILE
+	}
+	if len(header) > MIME_SNIFF_LENGTH {
+		header = header[:MIME_SNIFF_LENGTH]
+	}
+	contentType = this.detectMimeType(entryName, header)
+	log.Infof("[%s] extract entry %s done, content type: %s", req.ReqId, entryName, contentType)
+	return
+}
@@ -0,0 +1,80 @@
+package unzip
+
+import (
+	"path"
+	"strings"
+)
+
+// parse the comma separated glob patterns, the patterns are validated by path.Match, the pattern without '/'
+// matches the base name in any directory, the pattern ending with '/' matches all the files in the directory,
+// and '**' matches zero or more directories, the single directory name ending with '/' such as '__MACOSX/' also
+// matches the directory at any level, the other patterns with '/' such as 'assets/**' are matched from the root
+func parseGlobPatterns(patternsStr string) (patterns []string, err error) {
+	for _, pattern := range strings.Split(patternsStr, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		anyLevel := !strings.Contains(strings.TrimSuffix(pattern, "/"), "/")
+		if strings.HasSuffix(pattern, "/") {
+			pattern += "**"
+		}
+		if anyLevel {
+			pattern = "**/" + pattern
+		}
+		for _, segment := range strings.Split(pattern, "/") {
+			if _, matchErr := path.Match(segment, ""); matchErr != nil {
+				err = matchErr
+				return
+			}
+		}
+		patterns = append(patterns, pattern)
+	}
+	return
+}
+
+// the file is selected when it matches any of the include patterns or no include pattern is specified,
+// and does not match any of the exclude patterns, the normalized name is matched, or the original name
+// when it is unsafe and can not be normalized
+func (this *UnzipParams) selected(fileName, safeName string) bool {
+	if safeName == "" {
+		safeName = strings.Replace(fileName, "\\", "/", -1)
+	}
+	if len(this.Include) > 0 && !matchGlobPatterns(this.Include, safeName) {
+		return false
+	}
+	return !matchGlobPatterns(this.Exclude, safeName)
+}
+
+func matchGlobPatterns(patterns []string, fileName string) bool {
+	nameSegments := strings.Split(fileName, "/")
+	for _, pattern := range patterns {
+		if matchGlobSegments(strings.Split(pattern, "/"), nameSegments) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchGlobSegments(patternSegments, nameSegments []string) bool {
+	for len(patternSegments) > 0 {
+		if patternSegments[0] == "**" {
+			//try to match the rest of the pattern from every position
+			for i := 0; i <= len(nameSegments); i++ {
+				if matchGlobSegments(patternSegments[1:], nameSegments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(nameSegments) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(patternSegments[0], nameSegments[0]); !matched {
+			return false
+		}
+		patternSegments = patternSegments[1:]
+		nameSegments = nameSegments[1:]
+	}
+	return len(nameSegments) == 0
+}
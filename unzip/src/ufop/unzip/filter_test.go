@@ -0,0 +1,84 @@
+package unzip
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseGlobPatterns(t *testing.T) {
+	cases := []struct {
+		patternsStr string
+		patterns    []string
+	}{
+		{"*.html, *.js,,", []string{"**/*.html", "**/*.js"}},
+		{".DS_Store", []string{"**/.DS_Store"}},
+		{"__MACOSX/", []string{"**/__MACOSX/**"}},
+		{"assets/**", []string{"assets/**"}},
+		{"a/b/", []string{"a/b/**"}},
+		{"a/**/x.js", []string{"a/**/x.js"}},
+		{"**/assets/**", []string{"**/assets/**"}},
+		{"", nil},
+	}
+	for _, c := range cases {
+		patterns, err := parseGlobPatterns(c.patternsStr)
+		if err != nil {
+			t.Errorf("parseGlobPatterns(%q) error = %v", c.patternsStr, err)
+			continue
+		}
+		if !reflect.DeepEqual(patterns, c.patterns) {
+			t.Errorf("parseGlobPatterns(%q) = %q, want %q", c.patternsStr, patterns, c.patterns)
+		}
+	}
+
+	for _, patternsStr := range []string{"[a", "*.js,a/[/b"} {
+		if _, err := parseGlobPatterns(patternsStr); err == nil {
+			t.Errorf("parseGlobPatterns(%q) should fail", patternsStr)
+		}
+	}
+}
+
+func TestSelected(t *testing.T) {
+	cases := []struct {
+		include  string
+		exclude  string
+		fileName string
+		selected bool
+	}{
+		{"", "", "a/b.txt", true},
+		{"*.html", "", "index.html", true},
+		{"*.html", "", "sub/page.html", true},
+		{"*.html", "", "readme.md", false},
+		{"assets/**", "", "assets/img/a.png", true},
+		{"assets/**", "", "lib/assets/a.png", false},
+		{"**/assets/**", "", "lib/assets/a.png", true},
+		{"a/*.js", "", "a/x.js", true},
+		{"a/*.js", "", "a/b/x.js", false},
+		{"", "__MACOSX/", "__MACOSX/._index.html", false},
+		{"", "__MACOSX/", "sub/__MACOSX/._a", false},
+		{"", "__MACOSX/", "__MACOSX.txt", true},
+		{"", "a/b/", "a/b/c.txt", false},
+		{"", "a/b/", "x/a/b/c.txt", true},
+		{"", ".DS_Store", "x/y/.DS_Store", false},
+		{"", "a/**/x.js", "a/x.js", false},
+		{"", "a/**/x.js", "a/b/c/x.js", false},
+		{"", "a/**/x.js", "b/x.js", true},
+		{"*.js", "vendor/", "vendor/x.js", false},
+		{"*.js", "vendor/", "src/x.js", true},
+	}
+	for _, c := range cases {
+		params := UnzipParams{}
+		params.Include, _ = parseGlobPatterns(c.include)
+		params.Exclude, _ = parseGlobPatterns(c.exclude)
+		if selected := params.selected(c.fileName, c.fileName); selected != c.selected {
+			t.Errorf("include %q, exclude %q, selected(%q) = %v, want %v", c.include, c.exclude, c.fileName,
+				selected, c.selected)
+		}
+	}
+
+	//the unsafe name is matched by the original name with slashes
+	params := UnzipParams{}
+	params.Exclude, _ = parseGlobPatterns("*.exe")
+	if params.selected("..\\evil.exe", "") {
+		t.Error("unsafe name should be matched by the original name")
+	}
+}
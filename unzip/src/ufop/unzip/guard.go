@@ -0,0 +1,178 @@
+package unzip
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+)
+
+const (
+	//the compression ratio is checked only after the data unzipped exceeds this length, because the small
+	//files such as the empty or blank ones can have a very high ratio
+	UNZIP_RATIO_CHECK_MIN_LENGTH int64 = 1 * 1024 * 1024 //1MB
+)
+
+var (
+	errFileTooLarge   = errors.New("zip file length exceeds the limit")
+	errTooManyFiles   = errors.New("zip files count exceeds the limit")
+	errTotalTooLarge  = errors.New("total unzipped length exceeds the limit")
+	errRatioTooLarge  = errors.New("zip file compression ratio exceeds the limit")
+	errUnsafeFileName = errors.New("unsafe file name")
+)
+
+// unzipGuard 按照实际解压出的数据量检查单个文件大小、解压总大小以及压缩比的限制，防止压缩炸弹，
+// sourceRead 用来获取流式解压时已经读取的压缩包数据量，此时按照整个压缩包检查压缩比，
+// counter 由内嵌的压缩包共享，所以文件数量和解压总大小的限制作用于所有层级
+type unzipGuard struct {
+	maxFileLength  int64
+	maxTotalLength int64
+	maxRatio       int64
+	maxFileCount   int
+	sourceRead     func() int64
+	//the total unzipped length when the stream is started
+	sourceBase int64
+
+	counter *unzipCounter
+}
+
+type unzipCounter struct {
+	total int64
+	files int
+}
+
+func (this *Unzipper) newGuard() *unzipGuard {
+	return &unzipGuard{
+		maxFileLength:  this.maxFileLength,
+		maxTotalLength: this.maxTotalLength,
+		maxRatio:       this.maxCompressionRatio,
+		maxFileCount:   this.maxFileCount,
+		counter:        &unzipCounter{},
+	}
+}
+
+// the guard of the streamed archive, the counters are shared with this guard, and the compression ratio is
+// checked by the data unzipped from the stream
+func (this *unzipGuard) stream(sourceRead func() int64) *unzipGuard {
+	streamGuard := *this
+	streamGuard.sourceRead = sourceRead
+	streamGuard.sourceBase = this.counter.total
+	return &streamGuard
+}
+
+// count the files to extract, the files in all the nested archives are counted together
+func (this *unzipGuard) addFiles(count int) error {
+	this.counter.files += count
+	if this.counter.files > this.maxFileCount {
+		return errTooManyFiles
+	}
+	return nil
+}
+
+// wrap the reader of the file item, the compressed size is negative when unknown, and then the compression ratio
+// of the whole archive is checked
+func (this *unzipGuard) reader(reader io.Reader, compressedSize int64) io.Reader {
+	return &unzipGuardReader{
+		guard:          this,
+		reader:         reader,
+		compressedSize: compressedSize,
+	}
+}
+
+func (this *unzipGuard) check(fileLength, compressedSize int64) error {
+	if fileLength > this.maxFileLength {
+		return errFileTooLarge
+	}
+	if this.counter.total > this.maxTotalLength {
+		return errTotalTooLarge
+	}
+	if this.maxRatio > 0 {
+		unzipped, compressed := fileLength, compressedSize
+		if compressed < 0 && this.sourceRead != nil {
+			unzipped, compressed = this.counter.total-this.sourceBase, this.sourceRead()
+		}
+		if compressed >= 0 && unzipped > UNZIP_RATIO_CHECK_MIN_LENGTH && unzipped > compressed*this.maxRatio {
+			return errRatioTooLarge
+		}
+	}
+	return nil
+}
+
+func isGuardError(err error) bool {
+	return err == errFileTooLarge || err == errTotalTooLarge || err == errRatioTooLarge
+}
+
+type unzipGuardReader struct {
+	guard          *unzipGuard
+	reader         io.Reader
+	compressedSize int64
+	nread          int64
+	//the nested archive is not counted in the total length, only the files extracted from it are counted
+	uncounted bool
+}
+
+func (this *unzipGuardReader) Read(p []byte) (n int, err error) {
+	n, err = this.reader.Read(p)
+	this.nread += int64(n)
+	if !this.uncounted {
+		this.guard.counter.total += int64(n)
+	}
+	if checkErr := this.guard.check(this.nread, this.compressedSize); checkErr != nil {
+		err = checkErr
+	}
+	return
+}
+
+// stop counting the file in the total length and release its slot of the file count, the data read before is
+// removed from the total length, and the file length is still checked
+func (this *unzipGuardReader) uncount() {
+	if this.uncounted {
+		return
+	}
+	this.uncounted = true
+	this.guard.counter.total -= this.nread
+	this.guard.counter.files -= 1
+}
+
+// normalize the file name in the archive to a relative key, the backslashes are converted to slashes, and the
+// empty and '.' segments are removed, the names with control characters, '..' segments, absolute paths or too
+// many directory levels are rejected
+func sanitizeFileName(fileName string, maxDirDepth int) (safeName string, err error) {
+	for _, r := range fileName {
+		if unicode.IsControl(r) {
+			err = fmt.Errorf("%s, control characters are not allowed", errUnsafeFileName.Error())
+			return
+		}
+	}
+
+	name := strings.Replace(fileName, "\\", "/", -1)
+	if strings.HasPrefix(name, "/") || len(name) >= 2 && name[1] == ':' &&
+		(name[0] >= 'a' && name[0] <= 'z' || name[0] >= 'A' && name[0] <= 'Z') {
+		err = fmt.Errorf("%s, absolute path is not allowed", errUnsafeFileName.Error())
+		return
+	}
+
+	segments := make([]string, 0, strings.Count(name, "/")+1)
+	for _, segment := range strings.Split(name, "/") {
+		switch segment {
+		case "", ".":
+			continue
+		case "..":
+			err = fmt.Errorf("%s, '..' is not allowed", errUnsafeFileName.Error())
+			return
+		}
+		segments = append(segments, segment)
+	}
+	if len(segments) == 0 {
+		err = fmt.Errorf("%s, empty name", errUnsafeFileName.Error())
+		return
+	}
+	if len(segments)-1 > maxDirDepth {
+		err = fmt.Errorf("%s, directory depth exceeds the limit", errUnsafeFileName.Error())
+		return
+	}
+
+	safeName = strings.Join(segments, "/")
+	return
+}
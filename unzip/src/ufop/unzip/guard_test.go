@@ -0,0 +1,184 @@
+package unzip
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestSanitizeFileName(t *testing.T) {
+	cases := []struct {
+		fileName string
+		depth    int
+		safeName string
+	}{
+		{"a/b.txt", 8, "a/b.txt"},
+		{"./a//b.txt", 8, "a/b.txt"},
+		{"a/./b/", 8, "a/b"},
+		{"a\\b\\c.txt", 8, "a/b/c.txt"},
+		{"..a/b..txt", 8, "..a/b..txt"},
+		{"文档/说明.txt", 8, "文档/说明.txt"},
+		{"../x.txt", 8, ""},
+		{"a/../../x.txt", 8, ""},
+		{"a\\..\\x.txt", 8, ""},
+		{"/etc/passwd", 8, ""},
+		{"\\x.txt", 8, ""},
+		{"C:x.txt", 8, ""},
+		{"c:\\x.txt", 8, ""},
+		{"a\x00b.txt", 8, ""},
+		{"a\nb.txt", 8, ""},
+		{"a\x7fb.txt", 8, ""},
+		{"", 8, ""},
+		{"./", 8, ""},
+		{"a/b/c/d.txt", 3, "a/b/c/d.txt"},
+		{"a/b/c/d/e.txt", 3, ""},
+		{"a.txt", 0, "a.txt"},
+		{"a/b.txt", 0, ""},
+	}
+	for _, c := range cases {
+		safeName, err := sanitizeFileName(c.fileName, c.depth)
+		if safeName != c.safeName {
+			t.Errorf("sanitizeFileName(%q, %d) = %q, want %q", c.fileName, c.depth, safeName, c.safeName)
+		}
+		if (c.safeName == "") != (err != nil) {
+			t.Errorf("sanitizeFileName(%q, %d) error = %v", c.fileName, c.depth, err)
+		}
+	}
+}
+
+// read the data through the guard and return the guard error
+func readGuarded(guard *unzipGuard, size, compressedSize int64) error {
+	_, err := io.Copy(ioutil.Discard, guard.reader(bytes.NewReader(make([]byte, size)), compressedSize))
+	return err
+}
+
+func TestUnzipGuardLimits(t *testing.T) {
+	const mb = 1024 * 1024
+	cases := []struct {
+		name           string
+		maxFileLength  int64
+		maxTotalLength int64
+		maxRatio       int64
+		sizes          []int64
+		compressedSize int64
+		err            error
+	}{
+		{"within limits", 10 * mb, 20 * mb, 100, []int64{2 * mb, 2 * mb}, mb, nil},
+		{"file too large", 2 * mb, 20 * mb, 0, []int64{2*mb + 1}, -1, errFileTooLarge},
+		{"total too large", 10 * mb, 5 * mb, 0, []int64{2 * mb, 2 * mb, 2 * mb}, -1, errTotalTooLarge},
+		{"ratio too large", 10 * mb, 20 * mb, 100, []int64{2 * mb}, 1000, errRatioTooLarge},
+		{"ratio not checked", 10 * mb, 20 * mb, 0, []int64{2 * mb}, 1000, nil},
+		{"small file ratio", 10 * mb, 20 * mb, 100, []int64{mb}, 10, nil},
+		{"unknown compressed size", 10 * mb, 20 * mb, 100, []int64{2 * mb}, -1, nil},
+	}
+	for _, c := range cases {
+		guard := (&Unzipper{
+			maxFileLength:       c.maxFileLength,
+			maxTotalLength:      c.maxTotalLength,
+			maxCompressionRatio: c.maxRatio,
+			maxFileCount:        10,
+		}).newGuard()
+		var err error
+		for _, size := range c.sizes {
+			if err = readGuarded(guard, size, c.compressedSize); err != nil {
+				break
+			}
+		}
+		if err != c.err {
+			t.Errorf("%s: error = %v, want %v", c.name, err, c.err)
+		}
+	}
+}
+
+func TestUnzipGuardStream(t *testing.T) {
+	const mb = 1024 * 1024
+	guard := (&Unzipper{
+		maxFileLength:       10 * mb,
+		maxTotalLength:      20 * mb,
+		maxCompressionRatio: 100,
+		maxFileCount:        10,
+	}).newGuard()
+
+	//the ratio of the stream is checked by the source read from the stream only
+	if err := readGuarded(guard, 3*mb, -1); err != nil {
+		t.Fatal(err)
+	}
+	var sourceRead int64 = mb
+	streamGuard := guard.stream(func() int64 { return sourceRead })
+	if err := readGuarded(streamGuard, 2*mb, -1); err != nil {
+		t.Fatalf("stream ratio counted the data before the stream, %v", err)
+	}
+	sourceRead = 1000
+	if err := readGuarded(streamGuard, 2*mb, -1); err != errRatioTooLarge {
+		t.Fatalf("stream ratio error = %v, want %v", err, errRatioTooLarge)
+	}
+}
+
+func TestUnzipGuardNestedCounter(t *testing.T) {
+	const mb = 1024 * 1024
+	guard := (&Unzipper{
+		maxFileLength:  10 * mb,
+		maxTotalLength: 5 * mb,
+		maxFileCount:   3,
+	}).newGuard()
+	nestedGuard := guard.stream(func() int64 { return 0 })
+
+	if err := guard.addFiles(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := nestedGuard.addFiles(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := nestedGuard.addFiles(1); err != errTooManyFiles {
+		t.Fatalf("nested files error = %v, want %v", err, errTooManyFiles)
+	}
+
+	if err := readGuarded(guard, 3*mb, -1); err != nil {
+		t.Fatal(err)
+	}
+	if err := readGuarded(nestedGuard, 3*mb, -1); err != errTotalTooLarge {
+		t.Fatalf("nested total error = %v, want %v", err, errTotalTooLarge)
+	}
+	if guard.counter.total != nestedGuard.counter.total {
+		t.Fatalf("counter is not shared, %d != %d", guard.counter.total, nestedGuard.counter.total)
+	}
+}
+
+func TestUnzipGuardUncount(t *testing.T) {
+	const mb = 1024 * 1024
+	guard := (&Unzipper{
+		maxFileLength:  4 * mb,
+		maxTotalLength: 5 * mb,
+		maxFileCount:   2,
+	}).newGuard()
+	if err := guard.addFiles(2); err != nil {
+		t.Fatal(err)
+	}
+
+	//the nested archive is not counted after the magic bytes are peeked
+	archiveReader := guard.reader(bytes.NewReader(make([]byte, 3*mb)), -1)
+	if _, err := archiveReader.Read(make([]byte, 512)); err != nil {
+		t.Fatal(err)
+	}
+	archiveReader.(*unzipGuardReader).uncount()
+	if _, err := io.Copy(ioutil.Discard, archiveReader); err != nil {
+		t.Fatal(err)
+	}
+	if guard.counter.total != 0 || guard.counter.files != 1 {
+		t.Fatalf("counter = %+v, want the nested archive uncounted", *guard.counter)
+	}
+
+	//the files extracted from it are counted, and the file length is still checked for the archive
+	if err := guard.addFiles(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := readGuarded(guard, 4*mb, -1); err != nil {
+		t.Fatal(err)
+	}
+	largeReader := guard.reader(bytes.NewReader(make([]byte, 4*mb+1)), -1)
+	largeReader.(*unzipGuardReader).uncount()
+	if _, err := io.Copy(ioutil.Discard, largeReader); err != errFileTooLarge {
+		t.Fatalf("uncounted file error = %v, want %v", err, errFileTooLarge)
+	}
+}
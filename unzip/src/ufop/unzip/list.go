@@ -0,0 +1,306 @@
+package unzip
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"ufop"
+	"ufop/utils"
+
+	"github.com/qiniu/log"
+)
+
+const (
+	UNZIP_LIST_CMD_PREFIX = "unzip/list"
+)
+
+// the names of the compression methods of the zip file items
+var zipMethodNames = map[uint16]string{
+	zip.Store:   "store",
+	zip.Deflate: "deflate",
+	9:           "deflate64",
+	12:          "bzip2",
+	14:          "lzma",
+	93:          "zstd",
+	95:          "xz",
+	98:          "ppmd",
+}
+
+// UnzipListResult 为 list 命令的结果，列出压缩包中的所有文件和目录，不上传任何文件，
+// Error 不为空时表示压缩包超过文件数量或者解压总大小的限制，解压时整个任务会失败
+type UnzipListResult struct {
+	Format  string           `json:"format"`
+	Charset string           `json:"charset,omitempty"`
+	Comment string           `json:"comment,omitempty"`
+	Entries []UnzipListEntry `json:"entries"`
+	Summary UnzipListSummary `json:"summary"`
+	Error   string           `json:"error,omitempty"`
+}
+
+// UnzipListEntry 为压缩包中的文件项，RawName 为压缩包中记录的原始文件名称，Name 为按照 charset 解码之后的名称，
+// tar 压缩包中的 CompressedSize 为 -1，Method 为空，Error 不为空时表示解压时该文件会被拒绝或者导致任务失败
+type UnzipListEntry struct {
+	Name           string `json:"name"`
+	RawName        []byte `json:"rawName"`
+	Dir            bool   `json:"dir,omitempty"`
+	Size           int64  `json:"size"`
+	CompressedSize int64  `json:"compressedSize"`
+	Method         string `json:"method,omitempty"`
+	Encrypted      bool   `json:"encrypted,omitempty"`
+	Mtime          string `json:"mtime,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// UnzipListSummary 为文件项的统计，Size 为所有文件解压后的总大小，Rejected 为 Error 不为空的文件数
+type UnzipListSummary struct {
+	Files    int   `json:"files"`
+	Dirs     int   `json:"dirs"`
+	Size     int64 `json:"size"`
+	Rejected int   `json:"rejected"`
+}
+
+/*
+
+unzip/list/charset/<encoded charset>/format/<[zip|tar|tar.gz|tgz|tar.bz2|tbz2|tar.xz|txz]>
+
+*/
+func (this *Unzipper) parseList(cmd string) (params UnzipParams, err error) {
+	pattern := "^unzip/list(/charset/[0-9a-zA-Z-_=]+){0,1}" +
+		"(/format/(zip|tar|tgz|tbz2|txz|tar\\.gz|tar\\.bz2|tar\\.xz)){0,1}$"
+	matched, _ := regexp.MatchString(pattern, cmd)
+	if !matched {
+		err = errors.New("invalid unzip list command format")
+		return
+	}
+
+	err = parseArchiveParams(cmd, &params)
+	return
+}
+
+// list the entries of the archive without uploading, so no bucket or credentials are needed, the large remote
+// zip file is read by range requests and only the central directory is fetched
+func (this *Unzipper) list(req ufop.UfopRequest, ufopBody io.ReadCloser) (result interface{}, resultType int,
+	contentType string, err error) {
+	params, pErr := this.parseList(req.Cmd)
+	if pErr != nil {
+		err = pErr
+		return
+	}
+
+	archive, openErr := this.openArchive(req, params, ufopBody)
+	if openErr != nil {
+		err = openErr
+		return
+	}
+	defer archive.Close()
+
+	log.Infof("[%s] archive format: %s", req.ReqId, archive.Format)
+	var listResult UnzipListResult
+	if archive.ZipData == nil {
+		listResult, err = this.listTar(req, params, archive.Format, archive.Stream)
+	} else {
+		listResult, err = this.listZip(params, archive.ZipData, archive.Size)
+	}
+	if err != nil {
+		return
+	}
+	this.checkListLimits(&listResult)
+
+	log.Infof("[%s] list entries done, files: %d, dirs: %d, rejected: %d", req.ReqId, listResult.Summary.Files,
+		listResult.Summary.Dirs, listResult.Summary.Rejected)
+	//write result
+	result = listResult
+	resultType = ufop.RESULT_TYPE_JSON
+	contentType = ufop.CONTENT_TYPE_JSON
+	return
+}
+
+func (this *Unzipper) listZip(params UnzipParams, zipData io.ReaderAt, zipSize int64) (
+	listResult UnzipListResult, err error) {
+	zipReader, zipErr := zip.NewReader(zipData, zipSize)
+	if zipErr != nil {
+		err = fmt.Errorf("invalid zip file, %s", zipErr.Error())
+		return
+	}
+
+	listResult.Format = ARCHIVE_FORMAT_ZIP
+	listResult.Charset = params.Charset
+	if listResult.Charset == "" {
+		listResult.Charset = detectFileNameCharset(zipReader.File)
+	}
+	//the comment has no utf8 flag, so it is decoded in the charset of the names
+	listResult.Comment, _ = utils.DecodeString(listResult.Charset, zipReader.Comment)
+	listResult.Entries = make([]UnzipListEntry, 0, len(zipReader.File))
+
+	rewriter := this.newKeyRewriter(UnzipParams{})
+	for _, zipFile := range zipReader.File {
+		listEntry := UnzipListEntry{
+			RawName:        []byte(zipFile.Name),
+			Dir:            zipFile.FileInfo().IsDir(),
+			Size:           int64(zipFile.UncompressedSize64),
+			CompressedSize: int64(zipFile.CompressedSize64),
+			Method:         zipMethodName(zipFile),
+			Encrypted:      isZipFileEncrypted(zipFile),
+			Mtime:          formatModTime(zipFile.Modified),
+		}
+		fileName, nErr := decodeFileName(zipFile, listResult.Charset)
+		if nErr != nil {
+			listEntry.Name = zipFile.Name
+			listEntry.Error = fmt.Sprintf("unsupported file name encoding, %s", nErr.Error())
+		} else {
+			listEntry.Name = fileName
+			this.checkListEntry(&listEntry, rewriter)
+		}
+		//the compression method is checked after the name, because the rejected file is never opened
+		if listEntry.Error == "" && !listEntry.Dir {
+			if listEntry.Encrypted {
+				if cErr := checkZipEncryptionMethod(zipFile); cErr != nil {
+					listEntry.Error = cErr.Error()
+				}
+			} else if zipFile.Method != zip.Store && zipFile.Method != zip.Deflate {
+				listEntry.Error = zip.ErrAlgorithm.Error()
+			}
+		}
+		listResult.addEntry(listEntry)
+	}
+	return
+}
+
+// the tar file is read to the end, the links and the other special files are never extracted, so they are
+// not listed
+func (this *Unzipper) listTar(req ufop.UfopRequest, params UnzipParams, format string, srcReader io.Reader) (
+	listResult UnzipListResult, err error) {
+	limitReader := &archiveLimitReader{
+		reader:    srcReader,
+		remaining: this.maxZipFileLength,
+	}
+	tarStream, tErr := newTarStreamReader(format, limitReader)
+	if tErr != nil {
+		if limitReader.remaining < 0 {
+			err = errArchiveTooLarge
+		} else {
+			err = tErr
+		}
+		return
+	}
+
+	listResult.Format = format
+	listResult.Charset = params.Charset
+	listResult.Entries = make([]UnzipListEntry, 0, 100)
+
+	tarReader := tar.NewReader(tarStream)
+	rewriter := this.newKeyRewriter(UnzipParams{})
+	for {
+		//stop when the job is cancelled
+		if jErr := req.Job.Err(); jErr != nil {
+			err = jErr
+			return
+		}
+
+		tarHeader, hErr := tarReader.Next()
+		if hErr == io.EOF {
+			break
+		}
+		if hErr != nil {
+			if limitReader.remaining < 0 {
+				err = errArchiveTooLarge
+			} else {
+				err = fmt.Errorf("invalid tar file, %s", hErr.Error())
+			}
+			return
+		}
+		if tarHeader.Typeflag != tar.TypeReg && tarHeader.Typeflag != tar.TypeDir {
+			continue
+		}
+
+		listEntry := UnzipListEntry{
+			RawName:        []byte(tarHeader.Name),
+			Dir:            tarHeader.Typeflag == tar.TypeDir,
+			Size:           tarHeader.Size,
+			CompressedSize: -1,
+			Mtime:          formatModTime(tarHeader.ModTime),
+		}
+		fileName, nErr := decodeTarFileName(tarHeader, params.Charset)
+		if nErr != nil {
+			listEntry.Name = tarHeader.Name
+			listEntry.Error = fmt.Sprintf("unsupported file name encoding, %s", nErr.Error())
+		} else {
+			listEntry.Name = fileName
+			this.checkListEntry(&listEntry, rewriter)
+		}
+		listResult.addEntry(listEntry)
+	}
+	return
+}
+
+// check the entry as it is extracted, the unsafe or conflicting names are rejected, and the sizes in the header
+// are checked against the limits, the directories are never extracted, so they are not checked
+func (this *Unzipper) checkListEntry(listEntry *UnzipListEntry, rewriter *keyRewriter) {
+	if listEntry.Dir {
+		return
+	}
+	safeName, sErr := sanitizeFileName(listEntry.Name, this.maxDirDepth)
+	if sErr == nil {
+		_, _, sErr = rewriter.rewrite(safeName)
+	}
+	if sErr != nil {
+		listEntry.Error = sErr.Error()
+		return
+	}
+
+	if listEntry.Size > this.maxFileLength {
+		listEntry.Error = errFileTooLarge.Error()
+		return
+	}
+	if this.maxCompressionRatio > 0 && listEntry.CompressedSize >= 0 && listEntry.Size > UNZIP_RATIO_CHECK_MIN_LENGTH &&
+		listEntry.Size > listEntry.CompressedSize*this.maxCompressionRatio {
+		listEntry.Error = errRatioTooLarge.Error()
+		return
+	}
+}
+
+// check the file count and the total size of the files which are not rejected, unzip fails when exceeded
+func (this *Unzipper) checkListLimits(listResult *UnzipListResult) {
+	var totalSize int64
+	for _, listEntry := range listResult.Entries {
+		if !listEntry.Dir && listEntry.Error == "" {
+			totalSize += listEntry.Size
+		}
+	}
+	if listResult.Summary.Files > this.maxFileCount {
+		listResult.Error = errTooManyFiles.Error()
+	} else if totalSize > this.maxTotalLength {
+		listResult.Error = errTotalTooLarge.Error()
+	}
+}
+
+func (this *UnzipListResult) addEntry(listEntry UnzipListEntry) {
+	this.Entries = append(this.Entries, listEntry)
+	if listEntry.Dir {
+		this.Summary.Dirs += 1
+		return
+	}
+	this.Summary.Files += 1
+	this.Summary.Size += listEntry.Size
+	if listEntry.Error != "" {
+		this.Summary.Rejected += 1
+	}
+}
+
+// the method of the winzip aes encrypted file is the method of the data before encryption
+func zipMethodName(zipFile *zip.File) string {
+	method := zipFile.Method
+	if method == ZIP_METHOD_WINZIP_AES {
+		if aesExtra := parseWinzipAesExtra(zipFile.Extra); aesExtra != nil {
+			method = aesExtra.Method
+		}
+	}
+	if methodName, ok := zipMethodNames[method]; ok {
+		return methodName
+	}
+	return strconv.Itoa(int(method))
+}
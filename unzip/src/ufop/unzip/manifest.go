@@ -0,0 +1,158 @@
+package unzip
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+	"time"
+	"ufop"
+	"ufop/store"
+)
+
+const (
+	UNZIP_FILE_STATUS_UPLOADED  = "uploaded"
+	UNZIP_FILE_STATUS_FAILED    = "failed"
+	UNZIP_FILE_STATUS_REJECTED  = "rejected"
+	UNZIP_FILE_STATUS_UNCHANGED = "unchanged"
+	UNZIP_FILE_STATUS_DELETED   = "deleted"
+	UNZIP_FILE_STATUS_EXTRACTED = "extracted"
+	UNZIP_FILE_STATUS_RESUMED   = "resumed"
+)
+
+const (
+	MANIFEST_MIME_TYPE = "application/json"
+)
+
+// fileDigest 在读取文件内容的同时统计实际大小、计算 CRC32，并保留文件头用来检测 MIME 类型，
+// 同步模式下还计算 etag、md5 以及按照 s3 分块大小计算的每块的 md5，用来和已有的文件比较
+type fileDigest struct {
+	size   int64
+	crc32  hash.Hash32
+	header []byte
+	etag   *store.EtagHasher
+	md5    hash.Hash
+
+	//the md5 of the current part and the md5s of the parts finished, the same as the s3 multipart upload
+	partMd5  hash.Hash
+	partRead int64
+	partSums []byte
+}
+
+func newFileDigest(withHashes bool) *fileDigest {
+	digest := &fileDigest{
+		crc32:  crc32.NewIEEE(),
+		header: make([]byte, 0, MIME_SNIFF_LENGTH),
+	}
+	if withHashes {
+		digest.etag = store.NewEtagHasher()
+		digest.md5 = md5.New()
+		digest.partMd5 = md5.New()
+	}
+	return digest
+}
+
+func (this *fileDigest) Write(p []byte) (n int, err error) {
+	this.size += int64(len(p))
+	this.crc32.Write(p)
+	if this.etag != nil {
+		this.etag.Write(p)
+		this.md5.Write(p)
+		this.writeParts(p)
+	}
+	if remaining := MIME_SNIFF_LENGTH - len(this.header); remaining > 0 {
+		if remaining > len(p) {
+			remaining = len(p)
+		}
+		this.header = append(this.header, p[:remaining]...)
+	}
+	n = len(p)
+	return
+}
+
+func (this *fileDigest) writeParts(p []byte) {
+	for len(p) > 0 {
+		chunk := p
+		if remaining := store.S3_PART_SIZE - this.partRead; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		this.partMd5.Write(chunk)
+		this.partRead += int64(len(chunk))
+		if this.partRead == store.S3_PART_SIZE {
+			this.partSums = this.partMd5.Sum(this.partSums)
+			this.partMd5.Reset()
+			this.partRead = 0
+		}
+		p = p[len(chunk):]
+	}
+}
+
+// check whether the hash of the existing file is the hash of the content, it is the qiniu etag, or the md5 for
+// the stores such as s3, and the s3 etag of the multipart upload is '<md5 of the part md5s>-<part count>'
+func (this *fileDigest) matchHash(hash string) bool {
+	if hash == this.etag.Etag() || hash == hex.EncodeToString(this.md5.Sum(nil)) {
+		return true
+	}
+	if !strings.Contains(hash, "-") {
+		return false
+	}
+	partSums := this.partSums
+	if this.partRead > 0 {
+		partSums = this.partMd5.Sum(partSums)
+	}
+	multipartMd5 := md5.Sum(partSums)
+	return hash == fmt.Sprintf("%s-%d", hex.EncodeToString(multipartMd5[:]), len(partSums)/md5.Size)
+}
+
+// fill the size and crc32 of the file read
+func (this *fileDigest) fill(unzipFile *UnzipFile) {
+	unzipFile.Size = this.size
+	unzipFile.Crc32 = fmt.Sprintf("%08x", this.crc32.Sum32())
+}
+
+func formatModTime(modTime time.Time) string {
+	if modTime.IsZero() {
+		return ""
+	}
+	return modTime.UTC().Format(time.RFC3339)
+}
+
+// upload the result as a json object under the prefix, the manifest is uploaded after all the files, so its
+// own upload result is reported separately and not counted in the summary
+func (this *Unzipper) uploadManifest(req ufop.UfopRequest, params UnzipParams, unzipResult UnzipResult,
+	objStore store.ObjectStore) (manifestFile *UnzipFile) {
+	manifestFile = &UnzipFile{
+		Key:   params.Prefix + params.Manifest,
+		Mtime: formatModTime(time.Now()),
+	}
+	manifestData, mErr := json.Marshal(unzipResult)
+	if mErr != nil {
+		manifestFile.Status = UNZIP_FILE_STATUS_FAILED
+		manifestFile.Error = fmt.Sprintf("marshal manifest error, %s", mErr.Error())
+		return
+	}
+
+	digest := newFileDigest(false)
+	digest.Write(manifestData)
+	digest.fill(manifestFile)
+	manifestFile.MimeType = MANIFEST_MIME_TYPE
+
+	putExtra := store.PutExtra{
+		MimeType:  MANIFEST_MIME_TYPE,
+		Overwrite: params.Overwrite || params.Sync,
+		Headers:   this.matchHeaders(params.Manifest),
+	}
+	uploader := this.newUploader(req, objStore, params, nil)
+	uploader.put(manifestFile, func() (store.PutRet, error) {
+		return objStore.Put(req.Job.Context(), manifestFile.Key, bytes.NewReader(manifestData),
+			int64(len(manifestData)), &putExtra)
+	}, func() io.Reader {
+		return bytes.NewReader(manifestData)
+	})
+	return
+}
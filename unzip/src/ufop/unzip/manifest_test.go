@@ -0,0 +1,55 @@
+package unzip
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"ufop/store"
+)
+
+// the s3 etag of the data uploaded in parts of the part size
+func multipartEtag(data []byte, partSize int) string {
+	var partSums []byte
+	for offset := 0; offset < len(data); offset += partSize {
+		end := offset + partSize
+		if end > len(data) {
+			end = len(data)
+		}
+		partSum := md5.Sum(data[offset:end])
+		partSums = append(partSums, partSum[:]...)
+	}
+	multipartMd5 := md5.Sum(partSums)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(multipartMd5[:]), len(partSums)/md5.Size)
+}
+
+func TestFileDigestMatchHash(t *testing.T) {
+	for _, size := range []int{0, 100, store.S3_PART_SIZE, store.S3_PART_SIZE + 1, 2*store.S3_PART_SIZE + 100} {
+		data := bytes.Repeat([]byte("0123456789"), size/10+1)[:size]
+		digest := newFileDigest(true)
+		//write in the chunks not aligned with the parts
+		for offset := 0; offset < size; offset += 3000 {
+			end := offset + 3000
+			if end > size {
+				end = size
+			}
+			digest.Write(data[offset:end])
+		}
+
+		md5Sum := md5.Sum(data)
+		etag, _ := store.Etag(bytes.NewReader(data))
+		for _, hash := range []string{etag, hex.EncodeToString(md5Sum[:]), multipartEtag(data, store.S3_PART_SIZE)} {
+			if !digest.matchHash(hash) {
+				t.Errorf("size %d: hash %s does not match", size, hash)
+			}
+		}
+		if size > store.S3_PART_SIZE/2 {
+			for _, hash := range []string{multipartEtag(data, store.S3_PART_SIZE/2), "0123-1", ""} {
+				if digest.matchHash(hash) {
+					t.Errorf("size %d: hash %s matches", size, hash)
+				}
+			}
+		}
+	}
+}
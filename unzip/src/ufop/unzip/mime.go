@@ -0,0 +1,168 @@
+package unzip
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"ufop/store"
+)
+
+const (
+	//the length of the file header used to sniff the mime type
+	MIME_SNIFF_LENGTH = 512
+)
+
+// the built-in mime types by the extensions, the system mime table is not used, because it differs between
+// the servers and misses the types of the fonts and the videos in some systems
+var builtinMimeTypes = map[string]string{
+	//web pages
+	".html":  "text/html; charset=utf-8",
+	".htm":   "text/html; charset=utf-8",
+	".xhtml": "application/xhtml+xml",
+	".css":   "text/css; charset=utf-8",
+	".js":    "application/javascript; charset=utf-8",
+	".mjs":   "application/javascript; charset=utf-8",
+	".json":  "application/json",
+	".map":   "application/json",
+	".xml":   "text/xml; charset=utf-8",
+	".txt":   "text/plain; charset=utf-8",
+	".csv":   "text/csv; charset=utf-8",
+	".md":    "text/markdown; charset=utf-8",
+	".wasm":  "application/wasm",
+	".swf":   "application/x-shockwave-flash",
+	//images
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".avif": "image/avif",
+	".bmp":  "image/bmp",
+	".ico":  "image/x-icon",
+	".svg":  "image/svg+xml",
+	//fonts
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+	".ttf":   "font/ttf",
+	".otf":   "font/otf",
+	".eot":   "application/vnd.ms-fontobject",
+	//audios and videos
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".aac":  "audio/aac",
+	".wav":  "audio/wav",
+	".ogg":  "audio/ogg",
+	".flac": "audio/flac",
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".webm": "video/webm",
+	".ogv":  "video/ogg",
+	".mov":  "video/quicktime",
+	".flv":  "video/x-flv",
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+	".vtt":  "text/vtt; charset=utf-8",
+	//documents
+	".pdf":  "application/pdf",
+	".doc":  "application/msword",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xls":  "application/vnd.ms-excel",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".ppt":  "application/vnd.ms-powerpoint",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".zip":  "application/zip",
+}
+
+// the header name allowed in the header rules
+var headerNamePattern = regexp.MustCompile("^[0-9a-zA-Z-]+$")
+
+// UnzipHeaderRule 为按照文件名称设置的元数据头，Pattern 为逗号分隔的 glob 模式，格式和 include 参数相同
+type UnzipHeaderRule struct {
+	Pattern string            `json:"pattern"`
+	Headers map[string]string `json:"headers"`
+}
+
+type headerRule struct {
+	patterns []string
+	headers  map[string]string
+}
+
+// merge the mime types configured into the built-in ones, the extensions are case insensitive
+func newMimeTypes(configMimeTypes map[string]string) (mimeTypes map[string]string, err error) {
+	mimeTypes = make(map[string]string, len(builtinMimeTypes)+len(configMimeTypes))
+	for ext, mimeType := range builtinMimeTypes {
+		mimeTypes[ext] = mimeType
+	}
+	for ext, mimeType := range configMimeTypes {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if mimeType == "" {
+			err = fmt.Errorf("empty mime type of extension '%s'", ext)
+			return
+		}
+		mimeTypes[ext] = mimeType
+	}
+	return
+}
+
+// parse the header rules, the qiniu store saves the headers as the x-qn-meta- metadata, so the standard headers
+// are rejected instead of being saved as the metadata silently
+func parseHeaderRules(configRules []UnzipHeaderRule, storeType string) (rules []headerRule, err error) {
+	qiniuStore := storeType == "" || storeType == store.STORE_TYPE_QINIU
+	for _, configRule := range configRules {
+		patterns, pErr := parseGlobPatterns(configRule.Pattern)
+		if pErr != nil {
+			err = fmt.Errorf("invalid header pattern '%s', %s", configRule.Pattern, pErr.Error())
+			return
+		}
+		if len(patterns) == 0 {
+			err = errors.New("empty header pattern")
+			return
+		}
+		for name := range configRule.Headers {
+			if !headerNamePattern.MatchString(name) || strings.EqualFold(name, "Content-Type") {
+				err = fmt.Errorf("invalid header name '%s'", name)
+				return
+			}
+			if qiniuStore && store.StandardHeaders[http.CanonicalHeaderKey(name)] {
+				err = fmt.Errorf("header '%s' is not supported by the qiniu store, only the metadata is saved", name)
+				return
+			}
+		}
+		rules = append(rules, headerRule{
+			patterns: patterns,
+			headers:  configRule.Headers,
+		})
+	}
+	return
+}
+
+// detect the mime type of the file by the extension of the key, and sniff the file header when the extension
+// is unknown
+func (this *Unzipper) detectMimeType(fileKey string, header []byte) string {
+	if mimeType, ok := this.mimeTypes[strings.ToLower(path.Ext(fileKey))]; ok {
+		return mimeType
+	}
+	return http.DetectContentType(header)
+}
+
+// the headers of all the rules matching the file name are merged, the later rules take precedence
+func (this *Unzipper) matchHeaders(fileName string) (headers map[string]string) {
+	for _, rule := range this.headerRules {
+		if !matchGlobPatterns(rule.patterns, fileName) {
+			continue
+		}
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		for name, value := range rule.headers {
+			headers[name] = value
+		}
+	}
+	return
+}
@@ -0,0 +1,94 @@
+package unzip
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"time"
+	"ufop"
+
+	"github.com/qiniu/log"
+)
+
+const (
+	UNZIP_MAX_RECURSIVE_DEPTH = 5
+)
+
+// nestedArchiveReader 记录读取内嵌压缩包时的错误，缓存压缩包失败时错误信息会被包装，需要从这里获取超过限制的原始错误
+type nestedArchiveReader struct {
+	reader io.Reader
+	err    error
+}
+
+func (this *nestedArchiveReader) Read(p []byte) (n int, err error) {
+	n, err = this.reader.Read(p)
+	if err != nil && err != io.EOF {
+		this.err = err
+	}
+	return
+}
+
+// upload the file, or extract it under the directory named after it when it is a nested archive within the
+// recursive depth, the file with the archive extension but without the magic bytes is uploaded as it is
+func (this *Unzipper) extractFile(req ufop.UfopRequest, params UnzipParams, fileReader io.Reader, fileSize int64,
+	fileName string, modTime time.Time, uploader *unzipUploader, guard *unzipGuard, depth int) (err error) {
+	var format, dirName string
+	if depth < params.Recursive {
+		format, dirName = nestedArchiveFormat(fileName)
+	}
+	if format == "" {
+		err = uploader.upload(fileReader, fileSize, fileName, modTime)
+		return
+	}
+
+	peekReader := bufio.NewReaderSize(fileReader, ARCHIVE_PEEK_BUF_SIZE)
+	header, _ := peekReader.Peek(TAR_BLOCK_SIZE)
+	if !matchArchiveFormat(format, header) {
+		err = uploader.upload(peekReader, fileSize, fileName, modTime)
+		return
+	}
+
+	//the nested archive is not extracted as a file, so only the files in it count toward the limits
+	if guardReader, ok := fileReader.(*unzipGuardReader); ok {
+		guardReader.uncount()
+	}
+
+	log.Infof("[%s] extract nested archive %s, depth: %d", req.ReqId, fileName, depth+1)
+	archiveFile, nestedUploader := uploader.nestedUploader(fileName, dirName, fileSize, modTime)
+	//the names in the nested archive are only normalized, the patterns and the rewriting rules are not applied
+	nestedParams := params
+	nestedParams.Format = format
+	nestedParams.Include = nil
+	nestedParams.Exclude = nil
+	nestedParams.Strip = 0
+	nestedParams.Flatten = false
+	nestedParams.Rename = nil
+
+	archiveReader := &nestedArchiveReader{
+		reader: peekReader,
+	}
+	var archive *unzipArchive
+	archive, err = this.readArchive(req, format, archiveReader, fileSize)
+	if err == nil {
+		_, err = this.extractArchive(req, nestedParams, archive, nestedUploader, guard, depth+1)
+		archive.Close()
+	}
+	if err == nil {
+		return
+	}
+	if isGuardError(archiveReader.err) {
+		err = archiveReader.err
+		return
+	}
+	//the limits are applied to all the levels, so the whole job fails when any of them is exceeded
+	if isGuardError(err) || err == errTooManyFiles || err == errArchiveTooLarge || req.Job.Err() != nil {
+		return
+	}
+
+	//the invalid nested archive fails itself only
+	log.Warnf("[%s] extract nested archive %s failed, %s", req.ReqId, fileName, err.Error())
+	archiveFile.Status = UNZIP_FILE_STATUS_FAILED
+	archiveFile.Error = fmt.Sprintf("extract nested archive error, %s", err.Error())
+	err = nil
+	return
+}
@@ -0,0 +1,214 @@
+package unzip
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"ufop"
+)
+
+const (
+	UNZIP_RANGE_BLOCK_SIZE   int64 = 1 * 1024 * 1024 //1MB
+	UNZIP_RANGE_CACHE_BLOCKS       = 64
+)
+
+var (
+	errRangeNotSupported = errors.New("range request not supported")
+	errRangeChanged      = errors.New("resource changed during range requests")
+)
+
+// httpRangeReader 通过 HTTP Range 请求随机读取远程文件，数据按块读取并缓存，
+// 缓存的块数超过限制时淘汰最久未使用的块，Header 为文件开头的数据，用来识别文件格式，ETag 为源站返回的 ETag
+type httpRangeReader struct {
+	Size   int64
+	Header []byte
+	ETag   string
+
+	job         *ufop.UfopJob
+	url         string
+	blockSize   int64
+	cacheBlocks int
+
+	lock    sync.Mutex
+	blocks  map[int64]*list.Element
+	pending map[int64]*httpRangeFetch
+	lru     *list.List
+	fetches int
+}
+
+type httpRangeBlock struct {
+	index int64
+	data  []byte
+}
+
+// httpRangeFetch 为正在读取的块，同时读取相同块的请求等待 done 关闭后共用结果
+type httpRangeFetch struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// probe the range support of the origin by fetching the header of the file, return errRangeNotSupported
+// when the origin responds without range
+func newHttpRangeReader(job *ufop.UfopJob, url string, blockSize int64, cacheBlocks int) (
+	reader *httpRangeReader, err error) {
+	reader = &httpRangeReader{
+		job:         job,
+		url:         url,
+		blockSize:   blockSize,
+		cacheBlocks: cacheBlocks,
+		blocks:      make(map[int64]*list.Element),
+		pending:     make(map[int64]*httpRangeFetch),
+		lru:         list.New(),
+	}
+	reader.Header, reader.Size, reader.ETag, err = reader.fetch(0, TAR_BLOCK_SIZE)
+	return
+}
+
+// fetch the data in the range, and return the total size of the file from the Content-Range header, the blocks
+// after the probe are fetched with the If-Match of the probed etag, so the blocks are never mixed from different
+// versions of the resource, the weak etag can not be used by If-Match, and only the size is checked then
+func (this *httpRangeReader) fetch(offset, length int64) (data []byte, size int64, etag string, err error) {
+	httpReq, reqErr := http.NewRequest("GET", this.url, nil)
+	if reqErr != nil {
+		err = fmt.Errorf("retrieve resource data failed, %s", reqErr.Error())
+		return
+	}
+	httpReq.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	probed := this.Size > 0
+	if probed && this.ETag != "" && !strings.HasPrefix(this.ETag, "W/") {
+		httpReq.Header.Set("If-Match", this.ETag)
+	}
+
+	this.lock.Lock()
+	this.fetches += 1
+	this.lock.Unlock()
+	resp, respErr := http.DefaultClient.Do(httpReq.WithContext(this.job.Context()))
+	if respErr != nil {
+		err = fmt.Errorf("retrieve resource data failed, %s", respErr.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK, http.StatusPreconditionFailed:
+		//the whole content is returned when the If-Match fails on some origins
+		if probed {
+			err = errRangeChanged
+		} else {
+			err = errRangeNotSupported
+		}
+		return
+	case http.StatusRequestedRangeNotSatisfiable:
+		err = errRangeNotSupported
+		return
+	default:
+		err = fmt.Errorf("retrieve resource data failed, %s", resp.Status)
+		return
+	}
+
+	var start, end int64
+	_, scanErr := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size)
+	if scanErr != nil || start != offset {
+		err = errRangeNotSupported
+		return
+	}
+	etag = resp.Header.Get("ETag")
+	if probed && (size != this.Size || etag != this.ETag) {
+		err = errRangeChanged
+		return
+	}
+
+	data, err = ioutil.ReadAll(this.job.Reader(io.LimitReader(resp.Body, length)))
+	if err != nil {
+		err = fmt.Errorf("read resource data failed, %s", err.Error())
+		return
+	}
+	if int64(len(data)) != end-start+1 {
+		err = fmt.Errorf("read resource data failed, %s", io.ErrUnexpectedEOF.Error())
+		return
+	}
+	return
+}
+
+// get the block from the cache, or fetch it when not cached, the block is fetched without holding the lock so
+// that the other blocks can be read meanwhile, and the concurrent reads of the same block share one fetch
+func (this *httpRangeReader) block(index int64) (data []byte, err error) {
+	this.lock.Lock()
+	if elem, ok := this.blocks[index]; ok {
+		this.lru.MoveToFront(elem)
+		data = elem.Value.(*httpRangeBlock).data
+		this.lock.Unlock()
+		return
+	}
+	if pending, ok := this.pending[index]; ok {
+		this.lock.Unlock()
+		<-pending.done
+		data, err = pending.data, pending.err
+		return
+	}
+	pending := &httpRangeFetch{
+		done: make(chan struct{}),
+	}
+	this.pending[index] = pending
+	this.lock.Unlock()
+
+	pending.data, _, _, pending.err = this.fetch(index*this.blockSize, this.blockSize)
+
+	this.lock.Lock()
+	delete(this.pending, index)
+	if pending.err == nil {
+		this.blocks[index] = this.lru.PushFront(&httpRangeBlock{
+			index: index,
+			data:  pending.data,
+		})
+		for this.lru.Len() > this.cacheBlocks {
+			elem := this.lru.Back()
+			this.lru.Remove(elem)
+			delete(this.blocks, elem.Value.(*httpRangeBlock).index)
+		}
+	}
+	this.lock.Unlock()
+	close(pending.done)
+
+	data, err = pending.data, pending.err
+	return
+}
+
+func (this *httpRangeReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		err = errors.New("negative offset")
+		return
+	}
+	for n < len(p) && off+int64(n) < this.Size {
+		pos := off + int64(n)
+		data, blockErr := this.block(pos / this.blockSize)
+		if blockErr != nil {
+			err = blockErr
+			return
+		}
+		blockOffset := pos % this.blockSize
+		if blockOffset >= int64(len(data)) {
+			err = io.ErrUnexpectedEOF
+			return
+		}
+		n += copy(p[n:], data[blockOffset:])
+	}
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+// the count of the range requests sent
+func (this *httpRangeReader) Fetches() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.fetches
+}
@@ -0,0 +1,100 @@
+package unzip
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	//the separator between the pattern and the replacement of the rename rule
+	RENAME_RULE_SEPARATOR = "=>"
+)
+
+// renameRule 为文件名称的改写规则，匹配 Pattern 的部分被替换为 Replacement，Replacement 中可以使用 $1 引用分组
+type renameRule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// parse the rename rules, one rule per line in the format of '<regexp>=><replacement>'
+func parseRenameRules(rulesStr string) (rules []renameRule, err error) {
+	for _, line := range strings.Split(rulesStr, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		sepIndex := strings.Index(line, RENAME_RULE_SEPARATOR)
+		if sepIndex < 0 {
+			err = fmt.Errorf("rename rule '%s' has no '%s'", line, RENAME_RULE_SEPARATOR)
+			return
+		}
+		pattern, compileErr := regexp.Compile(line[:sepIndex])
+		if compileErr != nil {
+			err = compileErr
+			return
+		}
+		rules = append(rules, renameRule{
+			Pattern:     pattern,
+			Replacement: line[sepIndex+len(RENAME_RULE_SEPARATOR):],
+		})
+	}
+	return
+}
+
+// keyRewriter 按照 strip、flatten 和 rename 参数改写文件名称，并检查改写之后的名称是否和之前的文件冲突
+type keyRewriter struct {
+	strip       int
+	flatten     bool
+	renames     []renameRule
+	maxDirDepth int
+
+	//the rewritten names and the original names of the files
+	names map[string]string
+}
+
+func (this *Unzipper) newKeyRewriter(params UnzipParams) *keyRewriter {
+	return &keyRewriter{
+		strip:       params.Strip,
+		flatten:     params.Flatten,
+		renames:     params.Rename,
+		maxDirDepth: this.maxDirDepth,
+		names:       make(map[string]string),
+	}
+}
+
+// rewrite the normalized name, the leading directories are stripped first, then the directories are removed
+// when flattened, and the rename rules are applied in order at last, skip is true when nothing is left after
+// stripping, and the error is returned when the rewritten name is unsafe or conflicts with the previous files
+func (this *keyRewriter) rewrite(safeName string) (newName string, skip bool, err error) {
+	newName = safeName
+	if this.strip > 0 {
+		segments := strings.Split(newName, "/")
+		if len(segments) <= this.strip {
+			skip = true
+			return
+		}
+		newName = strings.Join(segments[this.strip:], "/")
+	}
+	if this.flatten {
+		newName = path.Base(newName)
+	}
+	for _, rule := range this.renames {
+		newName = rule.Pattern.ReplaceAllString(newName, rule.Replacement)
+	}
+	if newName != safeName {
+		newName, err = sanitizeFileName(newName, this.maxDirDepth)
+		if err != nil {
+			err = fmt.Errorf("%s after rewriting", err.Error())
+			return
+		}
+	}
+
+	if conflictName, ok := this.names[newName]; ok {
+		err = fmt.Errorf("name conflicts, '%s' is already used by file '%s'", newName, conflictName)
+		return
+	}
+	this.names[newName] = safeName
+	return
+}
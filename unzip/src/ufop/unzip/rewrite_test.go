@@ -0,0 +1,88 @@
+package unzip
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRenameRules(t *testing.T) {
+	rules, err := parseRenameRules("\\.htm$=>.html\r\n\n^src/(.*)=>$1\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].Replacement != ".html" || rules[1].Replacement != "$1" {
+		t.Fatalf("parseRenameRules = %v", rules)
+	}
+
+	for _, rulesStr := range []string{"a", "a=>b\n(=>c"} {
+		if _, err := parseRenameRules(rulesStr); err == nil {
+			t.Errorf("parseRenameRules(%q) should fail", rulesStr)
+		}
+	}
+}
+
+func TestKeyRewriter(t *testing.T) {
+	type rewriteCase struct {
+		safeName string
+		newName  string
+		skip     bool
+		err      string
+	}
+	cases := []struct {
+		name    string
+		strip   int
+		flatten bool
+		renames string
+		files   []rewriteCase
+	}{
+		{"unchanged", 0, false, "", []rewriteCase{
+			{"a/b.txt", "a/b.txt", false, ""},
+			{"c.txt", "c.txt", false, ""},
+		}},
+		{"strip", 1, false, "", []rewriteCase{
+			{"top/a/b.txt", "a/b.txt", false, ""},
+			{"top/c.txt", "c.txt", false, ""},
+			{"root.txt", "root.txt", true, ""},
+		}},
+		{"flatten", 0, true, "", []rewriteCase{
+			{"a/x.js", "x.js", false, ""},
+			{"b/x.js", "", false, "name conflicts, 'x.js' is already used by file 'a/x.js'"},
+			{"b/y.js", "y.js", false, ""},
+		}},
+		{"rename", 0, false, "\\.htm$=>.html\n^src/(.*)=>dist/$1", []rewriteCase{
+			{"src/index.htm", "dist/index.html", false, ""},
+			{"dist/index.html", "", false, "name conflicts"},
+			{"a.htm", "a.html", false, ""},
+		}},
+		{"unsafe rename", 0, false, "^evil=>../up\n^abs=>/x\n^deep=>a/b/c", []rewriteCase{
+			{"evil.txt", "", false, "after rewriting"},
+			{"abs.txt", "", false, "after rewriting"},
+			{"deep.txt", "", false, "directory depth exceeds the limit after rewriting"},
+		}},
+		{"strip flatten rename", 1, true, "\\.htm$=>.html", []rewriteCase{
+			{"top/a/index.htm", "index.html", false, ""},
+			{"top/b/index.htm", "", false, "name conflicts"},
+		}},
+	}
+	for _, c := range cases {
+		params := UnzipParams{
+			Strip:   c.strip,
+			Flatten: c.flatten,
+		}
+		params.Rename, _ = parseRenameRules(c.renames)
+		rewriter := (&Unzipper{maxDirDepth: 1}).newKeyRewriter(params)
+		for _, file := range c.files {
+			newName, skip, err := rewriter.rewrite(file.safeName)
+			if file.err != "" {
+				if err == nil || !strings.Contains(err.Error(), file.err) {
+					t.Errorf("%s: rewrite(%q) error = %v, want %q", c.name, file.safeName, err, file.err)
+				}
+				continue
+			}
+			if err != nil || newName != file.newName || skip != file.skip {
+				t.Errorf("%s: rewrite(%q) = %q, %v, %v, want %q, %v", c.name, file.safeName, newName, skip, err,
+					file.newName, file.skip)
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package unzip
+
+import (
+	"fmt"
+	"sort"
+	"ufop"
+	"ufop/store"
+
+	"github.com/qiniu/log"
+)
+
+const (
+	UNZIP_SYNC_LIST_LIMIT = 1000
+)
+
+// unzipSync 保存同步模式下 prefix 下已有文件的 hash，内容没有变化的文件不再上传，
+// 开启删除时压缩包中已经不存在的文件会被删除
+type unzipSync struct {
+	hashes map[string]string
+}
+
+// list all the existing files under the prefix
+func (this *Unzipper) newSync(req ufop.UfopRequest, params UnzipParams, objStore store.ObjectStore) (
+	syncState *unzipSync, err error) {
+	hashes := make(map[string]string)
+	marker := ""
+	for {
+		objects, nextMarker, lErr := objStore.List(params.Prefix, marker, UNZIP_SYNC_LIST_LIMIT)
+		if lErr != nil {
+			err = fmt.Errorf("list existing files failed, %s", lErr.Error())
+			return
+		}
+		for _, object := range objects {
+			hashes[object.Key] = object.Hash
+		}
+		if nextMarker == "" {
+			break
+		}
+		marker = nextMarker
+	}
+	log.Infof("[%s] existing files under prefix: %d", req.ReqId, len(hashes))
+
+	syncState = &unzipSync{
+		hashes: hashes,
+	}
+	return
+}
+
+// the file is unchanged when the hash of the existing file matches the content, the s3 multipart etag matches
+// only when the file is uploaded with the same part size
+func (this *unzipSync) unchanged(fileKey string, digest *fileDigest) (hash string, ok bool) {
+	hash, exists := this.hashes[fileKey]
+	if !exists {
+		return
+	}
+	ok = digest.matchHash(hash)
+	return
+}
+
+// delete the existing files which are not extracted from the archive, the keys kept such as the manifest are
+// not deleted, the files rejected or failed to upload are not deleted either, because their keys are in the
+// result
+func (this *unzipSync) deleteStale(req ufop.UfopRequest, objStore store.ObjectStore, unzipResult *UnzipResult,
+	keepKeys ...string) {
+	extracted := make(map[string]bool, len(unzipResult.Files)+len(keepKeys))
+	addExtractedKeys(extracted, unzipResult.Files)
+	for _, key := range keepKeys {
+		extracted[key] = true
+	}
+
+	staleKeys := make([]string, 0)
+	for key := range this.hashes {
+		if !extracted[key] {
+			staleKeys = append(staleKeys, key)
+		}
+	}
+	sort.Strings(staleKeys)
+
+	for _, key := range staleKeys {
+		//stop when the job is cancelled
+		if req.Job.Err() != nil {
+			return
+		}
+		deletedFile := UnzipFile{
+			Key:    key,
+			Hash:   this.hashes[key],
+			Status: UNZIP_FILE_STATUS_DELETED,
+		}
+		if dErr := objStore.Delete(key); dErr != nil && dErr != store.ErrNotFound {
+			log.Warnf("[%s] delete stale file %s failed, %s", req.ReqId, key, dErr.Error())
+			deletedFile.Status = UNZIP_FILE_STATUS_FAILED
+			deletedFile.Error = fmt.Sprintf("delete stale file error, %s", dErr.Error())
+		}
+		unzipResult.addDeleted(deletedFile)
+	}
+}
+
+// add the keys of the files including the ones in the nested archives
+func addExtractedKeys(extracted map[string]bool, unzipFiles []UnzipFile) {
+	for _, unzipFile := range unzipFiles {
+		extracted[unzipFile.Key] = true
+		addExtractedKeys(extracted, unzipFile.Files)
+	}
+}
@@ -0,0 +1,252 @@
+package unzip
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"ufop"
+	"ufop/store"
+
+	"github.com/qiniu/log"
+)
+
+const (
+	//the files are staged under '<staging dir>/<req id>/<prefix>' in the atomic mode, and the existing files
+	//overwritten are moved aside under '<staging dir>/<req id>.backup/<prefix>' until committed
+	UNZIP_STAGING_DIR        = ".unzip_staging/"
+	UNZIP_STAGING_BACKUP_EXT = ".backup/"
+	//the staged files left by the jobs interrupted, such as the process is killed, are deleted after this time
+	UNZIP_STAGING_EXPIRE = 24 * time.Hour
+)
+
+// unzipTransaction 将文件先上传到临时前缀下，全部上传成功之后批量移动到目标前缀，失败时删除临时文件，
+// 覆盖已有文件时先把已有文件移动到备份前缀，提交失败时恢复，这样空间中不会出现只解压了一部分的压缩包
+type unzipTransaction struct {
+	stagingPrefix string
+	backupPrefix  string
+}
+
+func newTransaction(req ufop.UfopRequest) *unzipTransaction {
+	return &unzipTransaction{
+		stagingPrefix: UNZIP_STAGING_DIR + req.ReqId + "/",
+		backupPrefix:  UNZIP_STAGING_DIR + req.ReqId + UNZIP_STAGING_BACKUP_EXT,
+	}
+}
+
+// the params to upload the files to the staging prefix, the staged files are always new
+func (this *unzipTransaction) stagingParams(params UnzipParams) UnzipParams {
+	stagingParams := params
+	stagingParams.Prefix = this.stagingPrefix + params.Prefix
+	stagingParams.Overwrite = true
+	return stagingParams
+}
+
+// move the staged files to the target keys, the keys in the result are changed to the target keys, and the error
+// is returned when any file is failed or can not be moved, the staged files left should be rolled back then
+func (this *unzipTransaction) commit(req ufop.UfopRequest, objStore store.ObjectStore, unzipResult *UnzipResult,
+	overwrite bool) (err error) {
+	if failedFile := findFailedFile(unzipResult.Files); failedFile != nil {
+		err = fmt.Errorf("unzip transaction aborted, file '%s' failed, %s",
+			strings.TrimPrefix(failedFile.Key, this.stagingPrefix), failedFile.Error)
+		return
+	}
+
+	moves := make([]store.MoveEntry, 0, len(unzipResult.Files))
+	this.collectMoves(unzipResult.Files, &moves)
+	log.Infof("[%s] commit the staged files: %d", req.ReqId, len(moves))
+
+	req.Job.SetPhase(ufop.JOB_PHASE_UPLOADING)
+	//move the existing files aside, so the staged files are always moved as new ones which can be undone
+	var backups []store.MoveEntry
+	if overwrite {
+		if backups, err = this.backup(req, objStore, moves); err != nil {
+			return
+		}
+	}
+	moveErrs := objStore.BatchMove(req.Job.Context(), moves, false)
+	for index, moveErr := range moveErrs {
+		if moveErr != nil {
+			err = fmt.Errorf("unzip transaction aborted, move file '%s' failed, %s", moves[index].DestKey,
+				moveErr.Error())
+			break
+		}
+	}
+	if err == nil {
+		this.deleteBackups(req, objStore, backups)
+		return
+	}
+
+	for index, moveErr := range moveErrs {
+		if moveErr != nil {
+			continue
+		}
+		if dErr := objStore.Delete(moves[index].DestKey); dErr != nil && dErr != store.ErrNotFound {
+			log.Errorf("[%s] undo the move of file %s failed, %s", req.ReqId, moves[index].DestKey,
+				dErr.Error())
+		}
+	}
+	this.restore(req, objStore, backups)
+	return
+}
+
+// move the existing target files to the backup prefix, the files not existing are skipped, and the files backed
+// up are restored when any of them can not be moved
+func (this *unzipTransaction) backup(req ufop.UfopRequest, objStore store.ObjectStore, moves []store.MoveEntry) (
+	backups []store.MoveEntry, err error) {
+	backupMoves := make([]store.MoveEntry, 0, len(moves))
+	for _, move := range moves {
+		backupMoves = append(backupMoves, store.MoveEntry{
+			SrcKey:  move.DestKey,
+			DestKey: this.backupPrefix + move.DestKey,
+		})
+	}
+	moveErrs := objStore.BatchMove(req.Job.Context(), backupMoves, true)
+	backups = make([]store.MoveEntry, 0)
+	for index, moveErr := range moveErrs {
+		if moveErr == nil {
+			backups = append(backups, backupMoves[index])
+		} else if moveErr != store.ErrNotFound && err == nil {
+			err = fmt.Errorf("unzip transaction aborted, backup file '%s' failed, %s", backupMoves[index].SrcKey,
+				moveErr.Error())
+		}
+	}
+	log.Infof("[%s] backup the overwritten files: %d", req.ReqId, len(backups))
+	if err != nil {
+		this.restore(req, objStore, backups)
+		backups = nil
+	}
+	return
+}
+
+// move the backup files back to the target keys, the backup files which can not be restored are kept for the
+// manual recovery, and never deleted by the sweeping
+func (this *unzipTransaction) restore(req ufop.UfopRequest, objStore store.ObjectStore, backups []store.MoveEntry) {
+	restoreMoves := make([]store.MoveEntry, 0, len(backups))
+	for _, backup := range backups {
+		restoreMoves = append(restoreMoves, store.MoveEntry{
+			SrcKey:  backup.DestKey,
+			DestKey: backup.SrcKey,
+		})
+	}
+	//the files are restored even if the job is cancelled
+	for index, moveErr := range objStore.BatchMove(context.Background(), restoreMoves, true) {
+		if moveErr != nil {
+			log.Errorf("[%s] restore file %s from %s failed, %s", req.ReqId, restoreMoves[index].DestKey,
+				restoreMoves[index].SrcKey, moveErr.Error())
+		}
+	}
+}
+
+func (this *unzipTransaction) deleteBackups(req ufop.UfopRequest, objStore store.ObjectStore,
+	backups []store.MoveEntry) {
+	for _, backup := range backups {
+		if dErr := objStore.Delete(backup.DestKey); dErr != nil && dErr != store.ErrNotFound {
+			log.Warnf("[%s] delete backup file %s failed, %s", req.ReqId, backup.DestKey, dErr.Error())
+		}
+	}
+}
+
+// delete the staged files left by the interrupted jobs, the staging directory of a job is deleted only when all
+// the files in it are expired, because the job may still be running, and the backup files are never deleted
+func (this *unzipTransaction) sweep(req ufop.UfopRequest, objStore store.ObjectStore) {
+	expireTime := time.Now().Add(-UNZIP_STAGING_EXPIRE).UnixNano() / 100
+	dirObjects := make(map[string][]string)
+	dirPutTimes := make(map[string]int64)
+	marker := ""
+	for {
+		objects, nextMarker, lErr := objStore.List(UNZIP_STAGING_DIR, marker, UNZIP_SYNC_LIST_LIMIT)
+		if lErr != nil {
+			log.Warnf("[%s] list the staging files failed, %s", req.ReqId, lErr.Error())
+			return
+		}
+		for _, object := range objects {
+			dirName := strings.SplitN(strings.TrimPrefix(object.Key, UNZIP_STAGING_DIR), "/", 2)[0] + "/"
+			if UNZIP_STAGING_DIR+dirName == this.stagingPrefix || strings.HasSuffix(dirName, UNZIP_STAGING_BACKUP_EXT) {
+				continue
+			}
+			dirObjects[dirName] = append(dirObjects[dirName], object.Key)
+			if object.PutTime > dirPutTimes[dirName] {
+				dirPutTimes[dirName] = object.PutTime
+			}
+		}
+		if nextMarker == "" {
+			break
+		}
+		marker = nextMarker
+	}
+
+	deleted := 0
+	for dirName, keys := range dirObjects {
+		if dirPutTimes[dirName] > expireTime {
+			continue
+		}
+		for _, key := range keys {
+			if dErr := objStore.Delete(key); dErr != nil && dErr != store.ErrNotFound {
+				log.Warnf("[%s] delete expired staging file %s failed, %s", req.ReqId, key, dErr.Error())
+				continue
+			}
+			deleted += 1
+		}
+	}
+	if deleted > 0 {
+		log.Infof("[%s] delete the expired staging files: %d", req.ReqId, deleted)
+	}
+}
+
+// delete all the files under the staging prefix, including the ones uploaded by the aborted uploads
+func (this *unzipTransaction) rollback(req ufop.UfopRequest, objStore store.ObjectStore) {
+	marker := ""
+	deleted := 0
+	for {
+		objects, nextMarker, lErr := objStore.List(this.stagingPrefix, marker, UNZIP_SYNC_LIST_LIMIT)
+		if lErr != nil {
+			log.Errorf("[%s] list staged files failed, %s", req.ReqId, lErr.Error())
+			return
+		}
+		for _, object := range objects {
+			if dErr := objStore.Delete(object.Key); dErr != nil && dErr != store.ErrNotFound {
+				log.Errorf("[%s] delete staged file %s failed, %s", req.ReqId, object.Key, dErr.Error())
+				continue
+			}
+			deleted += 1
+		}
+		if nextMarker == "" {
+			break
+		}
+		marker = nextMarker
+	}
+	log.Infof("[%s] rollback the staged files: %d", req.ReqId, deleted)
+}
+
+// collect the moves of the uploaded files and change the keys to the target ones
+func (this *unzipTransaction) collectMoves(unzipFiles []UnzipFile, moves *[]store.MoveEntry) {
+	for index := range unzipFiles {
+		unzipFile := &unzipFiles[index]
+		if !strings.HasPrefix(unzipFile.Key, this.stagingPrefix) {
+			continue
+		}
+		destKey := strings.TrimPrefix(unzipFile.Key, this.stagingPrefix)
+		if unzipFile.Status == UNZIP_FILE_STATUS_UPLOADED {
+			*moves = append(*moves, store.MoveEntry{
+				SrcKey:  unzipFile.Key,
+				DestKey: destKey,
+			})
+		}
+		unzipFile.Key = destKey
+		this.collectMoves(unzipFile.Files, moves)
+	}
+}
+
+// find the first file failed, including the ones in the nested archives
+func findFailedFile(unzipFiles []UnzipFile) *UnzipFile {
+	for index := range unzipFiles {
+		if unzipFiles[index].Error != "" {
+			return &unzipFiles[index]
+		}
+		if failedFile := findFailedFile(unzipFiles[index].Files); failedFile != nil {
+			return failedFile
+		}
+	}
+	return nil
+}
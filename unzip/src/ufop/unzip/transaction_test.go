@@ -0,0 +1,212 @@
+package unzip
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"ufop"
+	"ufop/store"
+)
+
+type transactionTest struct {
+	t        *testing.T
+	root     string
+	objStore store.ObjectStore
+	req      ufop.UfopRequest
+	tx       *unzipTransaction
+}
+
+func newTransactionTest(t *testing.T) *transactionTest {
+	root, _ := ioutil.TempDir("", "unzip_transaction")
+	objStore, err := store.NewLocalStore(root, "bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := ufop.UfopRequest{
+		ReqId: "req1",
+		Cmd:   "unzip/bucket/YnVja2V0/atomic/1",
+	}
+	req.Job = ufop.NewJob(req.ReqId, req.Cmd)
+	return &transactionTest{
+		t:        t,
+		root:     root,
+		objStore: objStore,
+		req:      req,
+		tx:       newTransaction(req),
+	}
+}
+
+func (this *transactionTest) put(key, content string) {
+	_, err := this.objStore.Put(context.Background(), key, strings.NewReader(content), int64(len(content)),
+		&store.PutExtra{Overwrite: true})
+	if err != nil {
+		this.t.Fatal(err)
+	}
+}
+
+// stage the file under the staging prefix and return its result
+func (this *transactionTest) stage(key, content string) UnzipFile {
+	this.put(this.tx.stagingPrefix+key, content)
+	return UnzipFile{
+		Key:    this.tx.stagingPrefix + key,
+		Size:   int64(len(content)),
+		Status: UNZIP_FILE_STATUS_UPLOADED,
+	}
+}
+
+// list all the files in the bucket with the contents
+func (this *transactionTest) files() map[string]string {
+	files := make(map[string]string)
+	bucketDir := filepath.Join(this.root, "bucket")
+	filepath.Walk(bucketDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			data, _ := ioutil.ReadFile(path)
+			relPath, _ := filepath.Rel(bucketDir, path)
+			files[filepath.ToSlash(relPath)] = string(data)
+		}
+		return nil
+	})
+	return files
+}
+
+func (this *transactionTest) expect(name string, files map[string]string) {
+	actual := this.files()
+	if len(actual) != len(files) {
+		this.t.Errorf("%s: files = %v, want %v", name, actual, files)
+		return
+	}
+	for key, content := range files {
+		if actual[key] != content {
+			this.t.Errorf("%s: files = %v, want %v", name, actual, files)
+			return
+		}
+	}
+}
+
+func TestTransactionCommit(t *testing.T) {
+	test := newTransactionTest(t)
+	defer os.RemoveAll(test.root)
+
+	//the keys in the result are changed to the target keys, including the ones in the nested archives
+	archiveFile := UnzipFile{
+		Key:    test.tx.stagingPrefix + "p/n.zip",
+		Status: UNZIP_FILE_STATUS_EXTRACTED,
+		Files:  []UnzipFile{test.stage("p/n/b.txt", "b")},
+	}
+	unzipResult := &UnzipResult{
+		Files: []UnzipFile{test.stage("p/a.txt", "a"), archiveFile},
+	}
+	if err := test.tx.commit(test.req, test.objStore, unzipResult, false); err != nil {
+		t.Fatal(err)
+	}
+	if unzipResult.Files[0].Key != "p/a.txt" || unzipResult.Files[1].Key != "p/n.zip" ||
+		unzipResult.Files[1].Files[0].Key != "p/n/b.txt" {
+		t.Errorf("result keys are not changed, %+v", unzipResult.Files)
+	}
+	test.expect("commit", map[string]string{"p/a.txt": "a", "p/n/b.txt": "b"})
+
+	//the existing file is kept when not overwritten
+	unzipResult = &UnzipResult{
+		Files: []UnzipFile{test.stage("p/c.txt", "c"), test.stage("p/a.txt", "a2")},
+	}
+	if err := test.tx.commit(test.req, test.objStore, unzipResult, false); err == nil {
+		t.Fatal("commit should fail when the file exists")
+	}
+	test.tx.rollback(test.req, test.objStore)
+	test.expect("commit existing", map[string]string{"p/a.txt": "a", "p/n/b.txt": "b"})
+
+	//the existing files are replaced when overwritten, and the backups are deleted
+	unzipResult = &UnzipResult{
+		Files: []UnzipFile{test.stage("p/a.txt", "a3"), test.stage("p/d.txt", "d")},
+	}
+	if err := test.tx.commit(test.req, test.objStore, unzipResult, true); err != nil {
+		t.Fatal(err)
+	}
+	test.expect("commit overwrite", map[string]string{"p/a.txt": "a3", "p/d.txt": "d", "p/n/b.txt": "b"})
+}
+
+func TestTransactionRestore(t *testing.T) {
+	test := newTransactionTest(t)
+	defer os.RemoveAll(test.root)
+	test.put("p/a.txt", "old")
+
+	//the file 'p/b.txt' is not staged, so its move fails after 'p/a.txt' is moved, and the overwritten file is
+	//restored from the backup
+	missingFile := UnzipFile{
+		Key:    test.tx.stagingPrefix + "p/b.txt",
+		Status: UNZIP_FILE_STATUS_UPLOADED,
+	}
+	unzipResult := &UnzipResult{
+		Files: []UnzipFile{test.stage("p/a.txt", "new"), missingFile},
+	}
+	if err := test.tx.commit(test.req, test.objStore, unzipResult, true); err == nil {
+		t.Fatal("commit should fail when the file can not be moved")
+	}
+	test.tx.rollback(test.req, test.objStore)
+	test.expect("restore", map[string]string{"p/a.txt": "old"})
+
+	//nothing is moved when any file is failed
+	failedFile := UnzipFile{
+		Key:    test.tx.stagingPrefix + "p/c.txt",
+		Status: UNZIP_FILE_STATUS_FAILED,
+		Error:  "save unzip file to bucket error",
+	}
+	unzipResult = &UnzipResult{
+		Files: []UnzipFile{test.stage("p/a.txt", "new"), failedFile},
+	}
+	err := test.tx.commit(test.req, test.objStore, unzipResult, true)
+	if err == nil || !strings.Contains(err.Error(), "file 'p/c.txt' failed") {
+		t.Fatalf("commit error = %v", err)
+	}
+	test.tx.rollback(test.req, test.objStore)
+	test.expect("failed file", map[string]string{"p/a.txt": "old"})
+}
+
+func TestTransactionSweep(t *testing.T) {
+	test := newTransactionTest(t)
+	defer os.RemoveAll(test.root)
+
+	expired := time.Now().Add(-UNZIP_STAGING_EXPIRE - time.Hour)
+	stagedFiles := []struct {
+		key     string
+		expired bool
+	}{
+		{UNZIP_STAGING_DIR + "old/a.txt", true},
+		{UNZIP_STAGING_DIR + "old/b/c.txt", true},
+		{UNZIP_STAGING_DIR + "partly/a.txt", true},
+		{UNZIP_STAGING_DIR + "partly/b.txt", false},
+		{UNZIP_STAGING_DIR + "recent/a.txt", false},
+		{UNZIP_STAGING_DIR + "old" + UNZIP_STAGING_BACKUP_EXT + "a.txt", true},
+		{test.tx.stagingPrefix + "a.txt", true},
+	}
+	for _, stagedFile := range stagedFiles {
+		test.put(stagedFile.key, "x")
+		if stagedFile.expired {
+			os.Chtimes(filepath.Join(test.root, "bucket", filepath.FromSlash(stagedFile.key)), expired, expired)
+		}
+	}
+
+	//only the directories of the other jobs with all the files expired are deleted, and the backups are kept
+	test.tx.sweep(test.req, test.objStore)
+	keys := make([]string, 0)
+	for key := range test.files() {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	expected := []string{
+		UNZIP_STAGING_DIR + "old" + UNZIP_STAGING_BACKUP_EXT + "a.txt",
+		UNZIP_STAGING_DIR + "partly/a.txt",
+		UNZIP_STAGING_DIR + "partly/b.txt",
+		UNZIP_STAGING_DIR + "recent/a.txt",
+		test.tx.stagingPrefix + "a.txt",
+	}
+	sort.Strings(expected)
+	if strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Errorf("files after sweeping = %v, want %v", keys, expected)
+	}
+}
@@ -1,62 +1,141 @@
 package unzip
 
 import (
+	"archive/tar"
 	"archive/zip"
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"net/http"
 	"os"
-	"path/filepath"
 	"regexp"
 	"strconv"
-	"time"
+	"strings"
 	"ufop"
+	"ufop/store"
 	"ufop/utils"
-	"unicode/utf8"
 
 	"github.com/qiniu/api.v6/auth/digest"
-	"github.com/qiniu/api.v6/conf"
-	fio "github.com/qiniu/api.v6/io"
-	rio "github.com/qiniu/api.v6/resumable/io"
-	"github.com/qiniu/api.v6/rs"
 	"github.com/qiniu/log"
-	"github.com/qiniu/rpc"
 )
 
 const (
-	UNZIP_MAX_ZIP_FILE_LENGTH int64 = 1 * 1024 * 1024 * 1024
-	UNZIP_MAX_FILE_LENGTH     int64 = 100 * 1024 * 1024 //100MB
-	UNZIP_MAX_FILE_COUNT      int   = 10                //10
+	UNZIP_MAX_ZIP_FILE_LENGTH   int64 = 1 * 1024 * 1024 * 1024
+	UNZIP_MAX_FILE_LENGTH       int64 = 100 * 1024 * 1024 //100MB
+	UNZIP_MAX_FILE_COUNT        int   = 10                //10
+	UNZIP_MAX_TOTAL_LENGTH      int64 = 1 * 1024 * 1024 * 1024
+	UNZIP_MAX_COMPRESSION_RATIO int64 = 100
+	UNZIP_MAX_DIR_DEPTH         int   = 32
 )
 
 const (
-	UNZIP_CACHE_ZIP_FILE_THRESHOLD  = 20 * 1024 * 1024 //20MB
 	UNZIP_CACHE_FILE_ITEM_THRESHOLD = 20 * 1024 * 1024 //20MB
 )
 
 const (
-	RESUMABLE_PUT_THRESHOLD = 20 * 1024 * 1024
+	//the general purpose flag bit of the utf8 file name
+	ZIP_FLAG_UTF8 = 0x800
 )
 
+const (
+	UNZIP_UPLOAD_WORKERS             = 8
+	UNZIP_UPLOAD_MEMORY_BUDGET int64 = 128 * 1024 * 1024 //128MB
+)
+
+const (
+	UNZIP_UPLOAD_RETRIES           = 3
+	UNZIP_UPLOAD_RETRY_BACKOFF     = 1  //seconds
+	UNZIP_UPLOAD_MAX_RETRY_BACKOFF = 30 //seconds
+)
+
+// UnzipParams 为 unzip 命令的参数，Charset 为指定的文件名编码，Format 为指定的压缩包格式，为空时自动检测，
+// Password 为加密的 zip 压缩包的密码，Include 和 Exclude 为选择需要解压的文件的 glob 模式，
+// Strip、Flatten 和 Rename 用来改写解压后的文件名称，Manifest 不为空时将解压结果保存为 prefix 下的同名 JSON 文件，
+// Sync 为同步模式，只上传新增和变化的文件，Delete 为同步时删除 prefix 下压缩包中已经不存在的文件，
+// Recursive 为解压内嵌压缩包的最大层数，为0时不解压内嵌的压缩包，Atomic 为全部文件上传成功之后才移动到 prefix 下，
+// Entry 为 entry 命令中规范化之后的文件名称
+type UnzipParams struct {
+	Bucket    string
+	Prefix    string
+	Overwrite bool
+	Charset   string
+	Format    string
+	Password  string
+	Include   []string
+	Exclude   []string
+	Strip     int
+	Flatten   bool
+	Rename    []renameRule
+	Manifest  string
+	Sync      bool
+	Delete    bool
+	Recursive int
+	Atomic    bool
+	Entry     string
+}
+
+// UnzipResult 为解压结果，Manifest 为保存解压结果的 JSON 文件的上传结果，不计入 Summary，
+// Deleted 为同步模式下删除的文件
 type UnzipResult struct {
-	Files []UnzipFile `json:"files"`
+	Charset  string       `json:"charset,omitempty"`
+	Files    []UnzipFile  `json:"files"`
+	Deleted  []UnzipFile  `json:"deleted,omitempty"`
+	Summary  UnzipSummary `json:"summary"`
+	Manifest *UnzipFile   `json:"manifest,omitempty"`
 }
 
+// UnzipFile 为单个文件的解压结果，Size 和 Crc32 按照实际解压出的数据计算，Mtime 为压缩包中记录的修改时间，
+// Status 为上传状态，uploaded、failed、rejected，同步模式下还可能为 unchanged 或者 deleted，
+// 内嵌的压缩包为 extracted，Files 为其中的文件的解压结果
 type UnzipFile struct {
-	Key   string `json:"key"`
-	Hash  string `json:"hash,omitempty"`
-	Error string `json:"error,omitempty"`
+	Key      string `json:"key"`
+	Hash     string `json:"hash,omitempty"`
+	Size     int64  `json:"size"`
+	Crc32    string `json:"crc32,omitempty"`
+	Mtime    string `json:"mtime,omitempty"`
+	MimeType string `json:"mimeType,omitempty"`
+	Status   string `json:"status"`
+	Retries  int    `json:"retries,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	Files []UnzipFile `json:"files,omitempty"`
+}
+
+// UnzipSummary 为上传结果的统计，Retried 为经过重试的文件数，这些文件同时计入 Succeeded 或者 Failed，
+// Unchanged 和 Deleted 为同步模式下跳过和删除的文件数，删除失败的文件计入 Failed，
+// Resumed 为从检查点恢复、之前已经上传完成的文件数，这些文件同时计入 Succeeded
+type UnzipSummary struct {
+	Succeeded int `json:"succeeded"`
+	Retried   int `json:"retried"`
+	Failed    int `json:"failed"`
+	Unchanged int `json:"unchanged,omitempty"`
+	Deleted   int `json:"deleted,omitempty"`
+	Resumed   int `json:"resumed,omitempty"`
 }
 
 type Unzipper struct {
 	mac              *digest.Mac
+	storeConfig      store.StoreConfig
+	uptokenManager   *store.UptokenManager
 	maxZipFileLength int64
 	maxFileLength    int64
 	maxFileCount     int
+
+	maxTotalLength      int64
+	maxCompressionRatio int64
+	maxDirDepth         int
+
+	uploadRetries      int
+	uploadRetryBackoff int
+	progressDir        string
+	checkpointDir      string
+	uploadWorkers      int
+	uploadMemoryBudget int64
+	rangeBlockSize     int64
+	rangeCacheBlocks   int
+
+	mimeTypes   map[string]string
+	headerRules []headerRule
 }
 
 type UnzipperConfig struct {
@@ -67,6 +146,34 @@ type UnzipperConfig struct {
 	UnzipMaxZipFileLength int64 `json:"unzip_max_zip_file_length,omitempty"`
 	UnzipMaxFileLength    int64 `json:"unzip_max_file_length,omitempty"`
 	UnzipMaxFileCount     int   `json:"unzip_max_file_count,omitempty"`
+
+	//limit the real data unzipped, against the zip bombs
+	UnzipMaxTotalLength      int64 `json:"unzip_max_total_length,omitempty"`
+	UnzipMaxCompressionRatio int64 `json:"unzip_max_compression_ratio,omitempty"`
+	UnzipMaxDirDepth         int   `json:"unzip_max_dir_depth,omitempty"`
+
+	//retry the upload when failed with temporary errors
+	UnzipUploadRetries      int    `json:"unzip_upload_retries,omitempty"`
+	UnzipUploadRetryBackoff int    `json:"unzip_upload_retry_backoff,omitempty"`
+	UnzipProgressDir        string `json:"unzip_progress_dir,omitempty"`
+
+	//record the uploaded files to resume the job when resubmitted, '-' to disable
+	UnzipCheckpointDir string `json:"unzip_checkpoint_dir,omitempty"`
+
+	//upload the files concurrently, the files cached in memory are limited by the memory budget
+	UnzipUploadWorkers      int   `json:"unzip_upload_workers,omitempty"`
+	UnzipUploadMemoryBudget int64 `json:"unzip_upload_memory_budget,omitempty"`
+
+	//read the large remote zip file by range requests, negative block size to disable
+	UnzipRangeBlockSize   int64 `json:"unzip_range_block_size,omitempty"`
+	UnzipRangeCacheBlocks int   `json:"unzip_range_cache_blocks,omitempty"`
+
+	//the mime types by the extensions which override the built-in ones, and the headers of the matched files
+	UnzipMimeTypes map[string]string `json:"unzip_mime_types,omitempty"`
+	UnzipHeaders   []UnzipHeaderRule `json:"unzip_headers,omitempty"`
+
+	//store to save the unzipped files, default is qiniu
+	store.StoreConfig
 }
 
 func (this *Unzipper) Name() string {
@@ -106,18 +213,114 @@ func (this *Unzipper) InitConfig(jobConf string) (err error) {
 		this.maxZipFileLength = config.UnzipMaxZipFileLength
 	}
 
+	if config.UnzipMaxTotalLength <= 0 {
+		this.maxTotalLength = UNZIP_MAX_TOTAL_LENGTH
+	} else {
+		this.maxTotalLength = config.UnzipMaxTotalLength
+	}
+
+	if config.UnzipMaxCompressionRatio < 0 {
+		this.maxCompressionRatio = 0
+	} else if config.UnzipMaxCompressionRatio == 0 {
+		this.maxCompressionRatio = UNZIP_MAX_COMPRESSION_RATIO
+	} else {
+		this.maxCompressionRatio = config.UnzipMaxCompressionRatio
+	}
+
+	if config.UnzipMaxDirDepth <= 0 {
+		this.maxDirDepth = UNZIP_MAX_DIR_DEPTH
+	} else {
+		this.maxDirDepth = config.UnzipMaxDirDepth
+	}
+
+	if config.UnzipUploadRetries < 0 {
+		this.uploadRetries = 0
+	} else if config.UnzipUploadRetries == 0 {
+		this.uploadRetries = UNZIP_UPLOAD_RETRIES
+	} else {
+		this.uploadRetries = config.UnzipUploadRetries
+	}
+
+	if config.UnzipUploadRetryBackoff <= 0 {
+		this.uploadRetryBackoff = UNZIP_UPLOAD_RETRY_BACKOFF
+	} else {
+		this.uploadRetryBackoff = config.UnzipUploadRetryBackoff
+	}
+
+	if config.UnzipProgressDir == "" {
+		this.progressDir = os.TempDir()
+	} else {
+		this.progressDir = config.UnzipProgressDir
+	}
+
+	if config.UnzipCheckpointDir == "" {
+		this.checkpointDir = this.progressDir
+	} else if config.UnzipCheckpointDir != "-" {
+		this.checkpointDir = config.UnzipCheckpointDir
+	}
+
+	if config.UnzipUploadWorkers <= 0 {
+		this.uploadWorkers = UNZIP_UPLOAD_WORKERS
+	} else {
+		this.uploadWorkers = config.UnzipUploadWorkers
+	}
+
+	if config.UnzipUploadMemoryBudget <= 0 {
+		this.uploadMemoryBudget = UNZIP_UPLOAD_MEMORY_BUDGET
+	} else {
+		this.uploadMemoryBudget = config.UnzipUploadMemoryBudget
+	}
+
+	if config.UnzipRangeBlockSize < 0 {
+		this.rangeBlockSize = 0
+	} else if config.UnzipRangeBlockSize == 0 {
+		this.rangeBlockSize = UNZIP_RANGE_BLOCK_SIZE
+	} else {
+		this.rangeBlockSize = config.UnzipRangeBlockSize
+	}
+
+	if config.UnzipRangeCacheBlocks <= 0 {
+		this.rangeCacheBlocks = UNZIP_RANGE_CACHE_BLOCKS
+	} else {
+		this.rangeCacheBlocks = config.UnzipRangeCacheBlocks
+	}
+
+	this.mimeTypes, err = newMimeTypes(config.UnzipMimeTypes)
+	if err != nil {
+		err = fmt.Errorf("Invalid unzip mime types config, %s", err.Error())
+		return
+	}
+
+	this.headerRules, err = parseHeaderRules(config.UnzipHeaders, config.StoreConfig.StoreType)
+	if err != nil {
+		err = fmt.Errorf("Invalid unzip headers config, %s", err.Error())
+		return
+	}
+
+	if checkErr := config.StoreConfig.Check(); checkErr != nil {
+		err = fmt.Errorf("Invalid unzip store config, %s", checkErr.Error())
+		return
+	}
+	this.storeConfig = config.StoreConfig
+
 	this.mac = &digest.Mac{config.AccessKey, []byte(config.SecretKey)}
+	this.uptokenManager = store.NewUptokenManager(&this.storeConfig, this.mac)
 
 	return
 }
 
 /*
 
-unzip/bucket/<encoded bucket>/prefix/<encoded prefix>/overwrite/<[0|1]>
+unzip/bucket/<encoded bucket>/prefix/<encoded prefix>/overwrite/<[0|1]>/charset/<encoded charset>/format/<[zip|tar|tar.gz|tgz|tar.bz2|tbz2|tar.xz|txz]>/password/<encoded password>/include/<encoded patterns>/exclude/<encoded patterns>/strip/<n>/flatten/<[0|1]>/rename/<encoded rules>/manifest/<encoded name>/sync/<[0|1]>/delete/<[0|1]>/recursive/<depth>/atomic/<[0|1]>
 
 */
-func (this *Unzipper) parse(cmd string) (bucket string, prefix string, overwrite bool, err error) {
-	pattern := "^unzip/bucket/[0-9a-zA-Z-_=]+(/prefix/[0-9a-zA-Z-_=]+){0,1}(/overwrite/(0|1)){0,1}$"
+func (this *Unzipper) parse(cmd string) (params UnzipParams, err error) {
+	pattern := "^unzip/bucket/[0-9a-zA-Z-_=]+(/prefix/[0-9a-zA-Z-_=]+){0,1}(/overwrite/(0|1)){0,1}" +
+		"(/charset/[0-9a-zA-Z-_=]+){0,1}(/format/(zip|tar|tgz|tbz2|txz|tar\\.gz|tar\\.bz2|tar\\.xz)){0,1}" +
+		"(/password/[0-9a-zA-Z-_=]+){0,1}(/include/[0-9a-zA-Z-_=]+){0,1}(/exclude/[0-9a-zA-Z-_=]+){0,1}" +
+		"(/strip/[0-9]+){0,1}(/flatten/(0|1)){0,1}(/rename/[0-9a-zA-Z-_=]+){0,1}" +
+		"(/manifest/[0-9a-zA-Z-_=]+){0,1}(/sync/(0|1)){0,1}(/delete/(0|1)){0,1}(/recursive/[0-9]+){0,1}" +
+		"(/atomic/(0|1)){0,1}$"
 	matched, _ := regexp.MatchString(pattern, cmd)
 	if !matched {
 		err = errors.New("invalid unzip command format")
@@ -125,12 +328,12 @@ func (this *Unzipper) parse(cmd string) (bucket string, prefix string, overwrite
 	}
 
 	var decodeErr error
-	bucket, decodeErr = utils.GetParamDecoded(cmd, "bucket/[0-9a-zA-Z-_=]+", "bucket")
+	params.Bucket, decodeErr = utils.GetParamDecoded(cmd, "bucket/[0-9a-zA-Z-_=]+", "bucket")
 	if decodeErr != nil {
 		err = errors.New("invalid unzip parameter 'bucket'")
 		return
 	}
-	prefix, decodeErr = utils.GetParamDecoded(cmd, "prefix/[0-9a-zA-Z-_=]+", "prefix")
+	params.Prefix, decodeErr = utils.GetParamDecoded(cmd, "prefix/[0-9a-zA-Z-_=]+", "prefix")
 	if decodeErr != nil {
 		err = errors.New("invalid unzip parameter 'prefix'")
 		return
@@ -143,278 +346,603 @@ func (this *Unzipper) parse(cmd string) (bucket string, prefix string, overwrite
 			return
 		}
 		if overwriteVal == 1 {
-			overwrite = true
+			params.Overwrite = true
 		}
 	}
+	if err = parseArchiveParams(cmd, &params); err != nil {
+		return
+	}
+	params.Password, decodeErr = utils.GetParamDecoded(cmd, "password/[0-9a-zA-Z-_=]+", "password")
+	if decodeErr != nil {
+		err = errors.New("invalid unzip parameter 'password'")
+		return
+	}
+	includeStr, decodeErr := utils.GetParamDecoded(cmd, "include/[0-9a-zA-Z-_=]+", "include")
+	if decodeErr != nil {
+		err = errors.New("invalid unzip parameter 'include'")
+		return
+	}
+	params.Include, err = parseGlobPatterns(includeStr)
+	if err != nil {
+		err = fmt.Errorf("invalid unzip parameter 'include', %s", err.Error())
+		return
+	}
+	excludeStr, decodeErr := utils.GetParamDecoded(cmd, "exclude/[0-9a-zA-Z-_=]+", "exclude")
+	if decodeErr != nil {
+		err = errors.New("invalid unzip parameter 'exclude'")
+		return
+	}
+	params.Exclude, err = parseGlobPatterns(excludeStr)
+	if err != nil {
+		err = fmt.Errorf("invalid unzip parameter 'exclude', %s", err.Error())
+		return
+	}
+	stripStr := utils.GetParam(cmd, "strip/[0-9]+", "strip")
+	if stripStr != "" {
+		stripVal, paramErr := strconv.Atoi(stripStr)
+		if paramErr != nil {
+			err = errors.New("invalid unzip parameter 'strip'")
+			return
+		}
+		params.Strip = stripVal
+	}
+	flattenStr := utils.GetParam(cmd, "flatten/(0|1)", "flatten")
+	if flattenStr == "1" {
+		params.Flatten = true
+	}
+	renameStr, decodeErr := utils.GetParamDecoded(cmd, "rename/[0-9a-zA-Z-_=]+", "rename")
+	if decodeErr != nil {
+		err = errors.New("invalid unzip parameter 'rename'")
+		return
+	}
+	params.Rename, err = parseRenameRules(renameStr)
+	if err != nil {
+		err = fmt.Errorf("invalid unzip parameter 'rename', %s", err.Error())
+		return
+	}
+	manifest, decodeErr := utils.GetParamDecoded(cmd, "manifest/[0-9a-zA-Z-_=]+", "manifest")
+	if decodeErr != nil {
+		err = errors.New("invalid unzip parameter 'manifest'")
+		return
+	}
+	if manifest != "" {
+		params.Manifest, err = sanitizeFileName(manifest, this.maxDirDepth)
+		if err != nil {
+			err = fmt.Errorf("invalid unzip parameter 'manifest', %s", err.Error())
+			return
+		}
+	}
+	syncStr := utils.GetParam(cmd, "sync/(0|1)", "sync")
+	if syncStr == "1" {
+		params.Sync = true
+	}
+	deleteStr := utils.GetParam(cmd, "delete/(0|1)", "delete")
+	if deleteStr == "1" {
+		//delete only the files under the prefix in the sync mode, never the whole bucket
+		if !params.Sync || params.Prefix == "" {
+			err = errors.New("invalid unzip parameter 'delete', only allowed with 'sync' and 'prefix'")
+			return
+		}
+		//the filtered files are still in the archive, and must not be deleted as the stale ones
+		if len(params.Include) > 0 || len(params.Exclude) > 0 {
+			err = errors.New("invalid unzip parameter 'delete', not allowed with 'include' or 'exclude'")
+			return
+		}
+		params.Delete = true
+	}
+	recursiveStr := utils.GetParam(cmd, "recursive/[0-9]+", "recursive")
+	if recursiveStr != "" {
+		recursiveVal, paramErr := strconv.Atoi(recursiveStr)
+		if paramErr != nil || recursiveVal > UNZIP_MAX_RECURSIVE_DEPTH {
+			err = fmt.Errorf("invalid unzip parameter 'recursive', should be no more than %d",
+				UNZIP_MAX_RECURSIVE_DEPTH)
+			return
+		}
+		params.Recursive = recursiveVal
+	}
+	atomicStr := utils.GetParam(cmd, "atomic/(0|1)", "atomic")
+	if atomicStr == "1" {
+		//the unchanged files are not staged in the sync mode, so they can not be committed together
+		if params.Sync {
+			err = errors.New("invalid unzip parameter 'atomic', not allowed with 'sync'")
+			return
+		}
+		params.Atomic = true
+	}
+	return
+}
+
+// parse the charset of the file names and the archive format, which are shared by the unzip and list commands
+func parseArchiveParams(cmd string, params *UnzipParams) (err error) {
+	charset, decodeErr := utils.GetParamDecoded(cmd, "charset/[0-9a-zA-Z-_=]+", "charset")
+	if decodeErr != nil {
+		err = errors.New("invalid unzip parameter 'charset'")
+		return
+	}
+	if charset != "" {
+		params.Charset, err = utils.LookupCharset(charset)
+		if err != nil {
+			err = fmt.Errorf("invalid unzip parameter 'charset', %s", err.Error())
+			return
+		}
+	}
+	formatStr := utils.GetParam(cmd, "format/[0-9a-z.]+", "format")
+	if formatStr != "" {
+		format, ok := archiveFormatAliases[formatStr]
+		if !ok {
+			err = errors.New("invalid unzip parameter 'format'")
+			return
+		}
+		params.Format = format
+	}
 	return
 }
 
 func (this *Unzipper) Do(req ufop.UfopRequest, ufopBody io.ReadCloser) (result interface{}, resultType int,
 	contentType string, err error) {
+	//list the entries of the archive only, or extract the single entry as the result
+	if strings.HasPrefix(req.Cmd, UNZIP_LIST_CMD_PREFIX) {
+		return this.list(req, ufopBody)
+	}
+	if strings.HasPrefix(req.Cmd, UNZIP_ENTRY_CMD_PREFIX) {
+		return this.entry(req, ufopBody)
+	}
+
 	//parse command
-	bucket, prefix, overwrite, pErr := this.parse(req.Cmd)
+	params, pErr := this.parse(req.Cmd)
 	if pErr != nil {
 		err = pErr
 		return
 	}
 
-	log.Infof("[%s] downloading file", req.ReqId)
-	//get resource
-	resUrl := req.Url
-	resResp, respErr := http.Get(resUrl)
-	if respErr != nil || resResp.StatusCode != 200 {
-		if respErr != nil {
-			err = fmt.Errorf("retrieve resource data failed, %s", respErr.Error())
-		} else {
-			err = fmt.Errorf("retrieve resource data failed, %s", resResp.Status)
-			if resResp.Body != nil {
-				resResp.Body.Close()
+	objStore, storeErr := store.New(&this.storeConfig, this.uptokenManager, params.Bucket)
+	if storeErr != nil {
+		err = storeErr
+		return
+	}
+
+	//list the existing files to compare with in the sync mode
+	var syncState *unzipSync
+	if params.Sync {
+		syncState, err = this.newSync(req, params, objStore)
+		if err != nil {
+			return
+		}
+	}
+
+	//stage the files under a temporary prefix in the atomic mode
+	uploadParams := params
+	var transaction *unzipTransaction
+	if params.Atomic {
+		transaction = newTransaction(req)
+		transaction.sweep(req, objStore)
+		uploadParams = transaction.stagingParams(params)
+	}
+
+	//the uploader and the guard are shared by the nested archives, so the limits apply to all the levels
+	uploader := this.newUploader(req, objStore, uploadParams, syncState)
+	defer uploader.closeCheckpoint(false)
+	defer uploader.wait()
+	guard := this.newGuard()
+	if transaction != nil {
+		//delete the staged files after all the uploads are done when failed
+		defer func() {
+			if err != nil {
+				uploader.wait()
+				transaction.rollback(req, objStore)
 			}
+		}()
+	}
+
+	var unzipResult UnzipResult
+	unzipResult.Charset, err = this.extractSource(req, params, ufopBody, uploader, guard)
+	if err != nil {
+		return
+	}
+	unzipResult.Files = make([]UnzipFile, 0, 100)
+	uploader.collect(&unzipResult)
+	//the checkpoint is kept to upload the failed files again when resubmitted
+	uploader.closeCheckpoint(unzipResult.Summary.Failed == 0)
+	//move the staged files to the prefix only when all the files are uploaded
+	if transaction != nil {
+		if err = transaction.commit(req, objStore, &unzipResult, params.Overwrite); err != nil {
+			return
+		}
+	}
+
+	log.Infof("[%s] upload files done, succeeded: %d, retried: %d, failed: %d, unchanged: %d, resumed: %d",
+		req.ReqId, unzipResult.Summary.Succeeded, unzipResult.Summary.Retried, unzipResult.Summary.Failed,
+		unzipResult.Summary.Unchanged, unzipResult.Summary.Resumed)
+	//delete the files no longer in the archive, only when all the files including the nested archives are
+	//extracted, because the keys of the failed ones are unknown or not uploaded
+	if params.Delete && unzipResult.Summary.Failed > 0 {
+		log.Warnf("[%s] delete stale files skipped, failed: %d", req.ReqId, unzipResult.Summary.Failed)
+	} else if params.Delete {
+		keepKeys := make([]string, 0, 1)
+		if params.Manifest != "" {
+			keepKeys = append(keepKeys, params.Prefix+params.Manifest)
 		}
+		syncState.deleteStale(req, objStore, &unzipResult, keepKeys...)
+		log.Infof("[%s] delete stale files done, deleted: %d", req.ReqId, unzipResult.Summary.Deleted)
+	}
+	//save the result as the manifest
+	if params.Manifest != "" {
+		unzipResult.Manifest = this.uploadManifest(req, params, unzipResult, objStore)
+		if unzipResult.Manifest.Error != "" {
+			log.Warnf("[%s] upload manifest %s failed, %s", req.ReqId, unzipResult.Manifest.Key,
+				unzipResult.Manifest.Error)
+		}
+	}
+	//write result
+	result = unzipResult
+	resultType = ufop.RESULT_TYPE_JSON
+	contentType = ufop.CONTENT_TYPE_JSON
+
+	return
+}
+
+// open the remote zip file for range reading, return nil when the file is small or not a zip file, or the origin
+// does not support range requests, and then the file is downloaded as a whole
+func (this *Unzipper) openRangeReader(req ufop.UfopRequest, params UnzipParams) *httpRangeReader {
+	if req.Url == "" || this.rangeBlockSize <= 0 {
+		return nil
+	}
+	if params.Format != "" && params.Format != ARCHIVE_FORMAT_ZIP {
+		return nil
+	}
+
+	rangeReader, rangeErr := newHttpRangeReader(req.Job, req.Url, this.rangeBlockSize, this.rangeCacheBlocks)
+	if rangeErr != nil {
+		log.Infof("[%s] range reading is not available, %s", req.ReqId, rangeErr.Error())
+		return nil
+	}
+	if rangeReader.Size <= ufop.SOURCE_CACHE_THRESHOLD {
+		return nil
+	}
+	if params.Format == "" && detectArchiveFormat(rangeReader.Header) != ARCHIVE_FORMAT_ZIP {
+		return nil
+	}
+	return rangeReader
+}
+
+// extract the archive of the source, the large remote zip file is read by range requests, and only the central
+// directory and the files are fetched
+func (this *Unzipper) extractSource(req ufop.UfopRequest, params UnzipParams, ufopBody io.ReadCloser,
+	uploader *unzipUploader, guard *unzipGuard) (charset string, err error) {
+	archive, openErr := this.openArchive(req, params, ufopBody)
+	if openErr != nil {
+		err = openErr
 		return
 	}
-	defer resResp.Body.Close()
-	reqSrcSize := resResp.ContentLength
-	reqSrcMime := resResp.Header.Get("Content-Type")
-
-	log.Infof("[%s] content length: %d, content type: %s", req.ReqId, reqSrcSize, reqSrcMime)
-	//check mimetype
-	//if !(reqSrcMime == "application/zip" || reqSrcMime == "application/x-zip-compressed") {
-	//	err = errors.New("unsupported mimetype to unzip")
-	//	return
-	//}
-	//check zip file length
-	if reqSrcSize > this.maxZipFileLength {
-		err = errors.New("src zip file length exceeds the limit")
+	defer archive.Close()
+
+	uploader.resume(archive.ETag)
+	charset, err = this.extractArchive(req, params, archive, uploader, guard, 0)
+	return
+}
+
+// extract the archive of the source or the nested one, the depth is 0 for the source
+func (this *Unzipper) extractArchive(req ufop.UfopRequest, params UnzipParams, archive *unzipArchive,
+	uploader *unzipUploader, guard *unzipGuard, depth int) (charset string, err error) {
+	log.Infof("[%s] archive format: %s, depth: %d", req.ReqId, archive.Format, depth)
+	if archive.ZipData == nil {
+		charset = params.Charset
+		err = this.extractTar(req, params, archive.Format, archive.Stream, uploader, guard, depth)
 		return
 	}
+	charset, err = this.extractZip(req, params, archive.ZipData, archive.Size, uploader, guard, depth)
+	return
+}
 
+func (this *Unzipper) extractZip(req ufop.UfopRequest, params UnzipParams, zipData io.ReaderAt, zipSize int64,
+	uploader *unzipUploader, guard *unzipGuard, depth int) (charset string, err error) {
 	//zip
-	var zipReader *zip.Reader
-	var zipErr error
-	//check the size of the src size file, when exceeds the threshold, use disk cache
-	if reqSrcSize > UNZIP_CACHE_ZIP_FILE_THRESHOLD {
-		log.Infof("[%s] trying to read zip into disk", req.ReqId)
-
-		zipFileCacheFname := utils.Md5Hex(fmt.Sprintf("%s:%d", req.Url, time.Now().Unix()))
-		zipFileCacheFpath := filepath.Join(os.TempDir(), zipFileCacheFname)
-		zipFileCacheFh, openErr := os.Create(zipFileCacheFpath)
-		defer os.Remove(zipFileCacheFpath)
-
-		if openErr != nil {
-			err = fmt.Errorf("open local zip cache file failed, %s", openErr.Error())
-			return
+	zipReader, zipErr := zip.NewReader(zipData, zipSize)
+	if zipErr != nil {
+		err = fmt.Errorf("invalid zip file, %s", zipErr.Error())
+		return
+	}
+
+	log.Infof("[%s] check and start to unzip", req.ReqId)
+	req.Job.SetPhase(ufop.JOB_PHASE_EXTRACTING)
+	//iter zip files
+	zipFiles := zipReader.File
+	//detect the charset of the file names if not specified
+	charset = params.Charset
+	if charset == "" {
+		charset = detectFileNameCharset(zipFiles)
+	}
+	log.Infof("[%s] file name charset: %s", req.ReqId, charset)
+
+	//select the files before checking the limits, so the files skipped are not counted
+	zipEntries, sErr := this.selectZipFiles(params, zipFiles, charset)
+	if sErr != nil {
+		err = sErr
+		return
+	}
+	//check file count, the files in the nested archives are counted together
+	if cErr := guard.addFiles(len(zipEntries)); cErr != nil {
+		err = cErr
+		return
+	}
+	//check file size, the sizes in the header are checked here, and the real sizes are checked when unzipping
+	var totalSize uint64
+	for _, zipEntry := range zipEntries {
+		zipFile := zipEntry.zipFile
+		if zipEntry.rejectErr != nil {
+			continue
 		}
-		_, cpErr := io.Copy(zipFileCacheFh, resResp.Body)
-		if cpErr != nil {
-			err = fmt.Errorf("write local zip cache file failed, %s", cpErr.Error())
+		fileSize := zipFile.UncompressedSize64
+		//check file size
+		if int64(fileSize) > this.maxFileLength {
+			err = errFileTooLarge
 			return
 		}
-		zipFileCacheFh.Close()
-
-		zipFileCacheFh, openErr = os.Open(zipFileCacheFpath)
-		if openErr != nil {
-			err = fmt.Errorf("reopen local zip cache file failed, %s", openErr.Error())
+		totalSize += fileSize
+		if totalSize > uint64(this.maxTotalLength) {
+			err = errTotalTooLarge
 			return
 		}
-		zipFileCacheStat, statErr := zipFileCacheFh.Stat()
-		if statErr != nil {
-			err = fmt.Errorf("reopen local zip cache file size error, %s", statErr.Error())
+		//check the encryption method before uploading any file
+		if cErr := checkZipFileEncryption(zipFile, params.Password); cErr != nil {
+			err = cErr
 			return
 		}
-		zipReader, zipErr = zip.NewReader(zipFileCacheFh, zipFileCacheStat.Size())
-		if zipErr != nil {
-			err = fmt.Errorf("invalid zip file, %s", zipErr.Error())
-			return
+	}
+
+	log.Infof("[%s] start to upload files", req.ReqId)
+	//iterate the zip file
+
+	for _, zipEntry := range zipEntries {
+		zipFile := zipEntry.zipFile
+		if zipEntry.rejectErr != nil {
+			log.Warnf("[%s] reject file %q, %s", req.ReqId, zipEntry.fileName, zipEntry.rejectErr.Error())
+			uploader.reject(zipEntry.fileName, zipEntry.rejectErr)
+			continue
 		}
-	} else {
-		log.Infof("[%s] trying to read zip into memory", req.ReqId)
-		respData, readErr := ioutil.ReadAll(resResp.Body)
-		if readErr != nil {
-			err = fmt.Errorf("read resource data failed, %s", readErr.Error())
+
+		//stop when the job is cancelled
+		if jErr := req.Job.Err(); jErr != nil {
+			err = jErr
 			return
 		}
 
-		//read zip
-		respReader := bytes.NewReader(respData)
-		zipReader, zipErr = zip.NewReader(respReader, int64(respReader.Len()))
+		zipFileReader, zipErr := openZipFile(zipFile, params.Password)
 		if zipErr != nil {
-			err = fmt.Errorf("invalid zip file, %s", zipErr.Error())
+			if zipErr == errZipWrongPassword {
+				err = zipErr
+			} else {
+				err = fmt.Errorf("open zip file content failed, %s", zipErr.Error())
+			}
 			return
 		}
-	}
 
-	log.Infof("[%s] check and start to unzip", req.ReqId)
-	//iter zip files
-	zipFiles := zipReader.File
-	//check file count
-	zipFileCount := len(zipFiles)
-	if zipFileCount > this.maxFileCount {
-		err = errors.New("zip files count exceeds the limit")
-		return
-	}
-	//check file size
-	for _, zipFile := range zipFiles {
-		fileSize := zipFile.UncompressedSize64
-		//check file size
-		if int64(fileSize) > this.maxFileLength {
-			err = errors.New("zip file length exceeds the limit")
+		//save file to bucket, or extract it when it is a nested archive
+		fileReader := guard.reader(zipFileReader, int64(zipFile.CompressedSize64))
+		uErr := this.extractFile(req, params, fileReader, int64(zipFile.UncompressedSize64), zipEntry.safeName,
+			zipFile.Modified, uploader, guard, depth)
+		zipFileReader.Close()
+		if uErr != nil {
+			err = uErr
 			return
 		}
 	}
+	return
+}
 
-	log.Infof("[%s] start to upload files", req.ReqId)
-	//set up host
-	conf.UP_HOST = "http://up.qiniu.com"
-	rputSettings := rio.Settings{
-		ChunkSize: 4 * 1024 * 1024,
-		Workers:   8,
+// the tar file is extracted from the stream, and each file is uploaded as soon as it is read, so the limits
+// are checked when the file is met, and the files before the one exceeding the limits are already uploaded
+func (this *Unzipper) extractTar(req ufop.UfopRequest, params UnzipParams, format string, srcReader io.Reader,
+	uploader *unzipUploader, guard *unzipGuard, depth int) (err error) {
+	limitReader := &archiveLimitReader{
+		reader:    srcReader,
+		remaining: this.maxZipFileLength,
 	}
-	rio.SetSettings(&rputSettings)
-	policy := rs.PutPolicy{
-		Scope: bucket,
+	tarStream, tErr := newTarStreamReader(format, limitReader)
+	if tErr != nil {
+		if limitReader.remaining < 0 {
+			err = errArchiveTooLarge
+		} else {
+			err = tErr
+		}
+		return
 	}
-	policy.Expires = 24 * 3600 //24 hours
 
-	var unzipResult UnzipResult
-	unzipResult.Files = make([]UnzipFile, 0, 100)
-	var tErr error
-	//iterate the zip file
+	log.Infof("[%s] check and start to untar", req.ReqId)
+	req.Job.SetPhase(ufop.JOB_PHASE_EXTRACTING)
+	tarReader := tar.NewReader(tarStream)
 
-	for _, zipFile := range zipFiles {
-		fileInfo := zipFile.FileHeader.FileInfo()
-		fileName := zipFile.FileHeader.Name
-		fileSize := zipFile.UncompressedSize64
+	//the compression ratio is checked for the whole archive, because the compressed size of each file is unknown
+	sourceRead := func() int64 {
+		return this.maxZipFileLength - limitReader.remaining
+	}
+	streamGuard := guard.stream(sourceRead)
+	rewriter := this.newKeyRewriter(params)
+	for {
+		//stop when the job is cancelled
+		if jErr := req.Job.Err(); jErr != nil {
+			err = jErr
+			return
+		}
 
-		if !utf8.Valid([]byte(fileName)) {
-			fileName, tErr = utils.Gbk2Utf8(fileName)
-			if tErr != nil {
-				err = fmt.Errorf("unsupported file name encoding, %s", tErr.Error())
-				return
+		tarHeader, hErr := tarReader.Next()
+		if hErr == io.EOF {
+			break
+		}
+		if hErr != nil {
+			if limitReader.remaining < 0 {
+				err = errArchiveTooLarge
+			} else {
+				err = fmt.Errorf("invalid tar file, %s", hErr.Error())
 			}
+			return
 		}
 
-		if fileInfo.IsDir() {
+		//only the regular files are extracted, the directories and links are skipped
+		if tarHeader.Typeflag != tar.TypeReg {
 			continue
 		}
 
-		var unzipFile UnzipFile
+		fileName, nErr := decodeTarFileName(tarHeader, params.Charset)
+		if nErr != nil {
+			err = fmt.Errorf("unsupported file name encoding, %s", nErr.Error())
+			return
+		}
+		//select the file before checking the limits, so the files skipped are not counted
+		safeName, sErr := sanitizeFileName(fileName, this.maxDirDepth)
+		if !params.selected(fileName, safeName) {
+			continue
+		}
+		//rewrite the name, the file with nothing left after stripping is skipped
+		if sErr == nil {
+			var skip bool
+			safeName, skip, sErr = rewriter.rewrite(safeName)
+			if skip {
+				continue
+			}
+		}
 
-		//save file to bucket
-		fileKey := prefix + fileName
-		unzipFile.Key = fileKey
+		if cErr := streamGuard.addFiles(1); cErr != nil {
+			err = cErr
+			return
+		}
+		if sErr != nil {
+			log.Warnf("[%s] reject file %q, %s", req.ReqId, fileName, sErr.Error())
+			uploader.reject(fileName, sErr)
+			continue
+		}
+		if tarHeader.Size > this.maxFileLength {
+			err = errFileTooLarge
+			return
+		}
 
-		if overwrite {
-			policy.Scope = bucket + ":" + fileKey
+		//save file to bucket, or extract it when it is a nested archive
+		uErr := this.extractFile(req, params, streamGuard.reader(tarReader, -1), tarHeader.Size, safeName,
+			tarHeader.ModTime, uploader, streamGuard, depth)
+		if uErr != nil {
+			if limitReader.remaining < 0 {
+				err = errArchiveTooLarge
+			} else {
+				err = uErr
+			}
+			return
 		}
+	}
+	return
+}
 
-		uptoken := policy.Token(this.mac)
+func (this *UnzipResult) addFile(unzipFile UnzipFile) {
+	this.Files = append(this.Files, unzipFile)
+	this.Summary.addFile(unzipFile)
+}
 
-		zipFileReader, zipErr := zipFile.Open()
-		if zipErr != nil {
-			err = fmt.Errorf("open zip file content failed, %s", zipErr.Error())
-			return
+// the nested archive is not counted, but the files in it
+func (this *UnzipSummary) addFile(unzipFile UnzipFile) {
+	if unzipFile.Status == UNZIP_FILE_STATUS_EXTRACTED {
+		for _, nestedFile := range unzipFile.Files {
+			this.addFile(nestedFile)
 		}
+	} else if unzipFile.Status == UNZIP_FILE_STATUS_UNCHANGED {
+		this.Unchanged += 1
+	} else if unzipFile.Error == "" {
+		this.Succeeded += 1
+	} else {
+		this.Failed += 1
+	}
+	if unzipFile.Status == UNZIP_FILE_STATUS_RESUMED {
+		this.Resumed += 1
+	}
+	if unzipFile.Retries > 0 {
+		this.Retried += 1
+	}
+}
+
+func (this *UnzipResult) addDeleted(deletedFile UnzipFile) {
+	this.Deleted = append(this.Deleted, deletedFile)
+	if deletedFile.Error == "" {
+		this.Summary.Deleted += 1
+	} else {
+		this.Summary.Failed += 1
+	}
+}
 
-		if fileSize > UNZIP_CACHE_FILE_ITEM_THRESHOLD {
-			zipFileItemCacheFname := utils.Md5Hex(fmt.Sprintf("%s:%s:%d", req.Url, fileName, time.Now().Unix()))
-			zipFileItemCacheFpath := filepath.Join(os.TempDir(), zipFileItemCacheFname)
-			zipFileItemCacheFh, openErr := os.Create(zipFileItemCacheFpath)
-			defer os.Remove(zipFileItemCacheFpath)
+// zipEntry 为选择需要解压的 zip 文件项，safeName 为规范化和改写之后的文件名称，
+// rejectErr 不为空时表示文件名称不安全或者和其他文件冲突，不能解压
+type zipEntry struct {
+	zipFile   *zip.File
+	fileName  string
+	safeName  string
+	rejectErr error
+}
 
-			if openErr != nil {
-				err = fmt.Errorf("open local cache file item failed, %s", openErr.Error())
-				return
-			}
+// decode the names of the files, select the files by the patterns and rewrite the names, the directories and
+// the files with nothing left after stripping are skipped
+func (this *Unzipper) selectZipFiles(params UnzipParams, zipFiles []*zip.File, charset string) (
+	zipEntries []zipEntry, err error) {
+	zipEntries = make([]zipEntry, 0, len(zipFiles))
+	rewriter := this.newKeyRewriter(params)
+	for _, zipFile := range zipFiles {
+		fileName, tErr := decodeFileName(zipFile, charset)
+		if tErr != nil {
+			err = fmt.Errorf("unsupported file name encoding, %s", tErr.Error())
+			return
+		}
 
-			_, cpErr := io.Copy(zipFileItemCacheFh, zipFileReader)
-			if cpErr != nil {
-				err = fmt.Errorf("write local cache file item failed, %s", cpErr.Error())
-				zipFileItemCacheFh.Close()
-				return
-			}
-			zipFileItemCacheFh.Close()
-			zipFileReader.Close()
-
-			if fileSize <= RESUMABLE_PUT_THRESHOLD {
-				log.Infof("[%s] start to fput file %s", req.ReqId, fileName)
-				var fputRet fio.PutRet
-				fErr := fio.PutFile(nil, &fputRet, uptoken, fileKey, zipFileItemCacheFpath, nil)
-				if fErr != nil {
-					if v, ok := fErr.(*rpc.ErrorInfo); ok {
-						unzipFile.Error = fmt.Sprintf("save unzip file to bucket error, %s", v.Err)
-					} else {
-						unzipFile.Error = fmt.Sprintf("save unzip file to bucket error, %s", fErr.Error())
-					}
-				} else {
-					unzipFile.Hash = fputRet.Hash
-				}
-				log.Infof("[%s] end fput file %s", req.ReqId, fileName)
-			} else {
-				log.Infof("[%s] start to rput file %s", req.ReqId, fileName)
-				var rputRet rio.PutRet
-				rErr := rio.PutFile(nil, &rputRet, uptoken, fileKey, zipFileItemCacheFpath, nil)
-				if rErr != nil {
-					if v, ok := rErr.(*rpc.ErrorInfo); ok {
-						unzipFile.Error = fmt.Sprintf("save unzip file to bucket error, %s", v.Err)
-					} else {
-						unzipFile.Error = fmt.Sprintf("save unzip file to bucket error, %s", rErr.Error())
-					}
-				} else {
-					unzipFile.Hash = rputRet.Hash
-				}
-				log.Infof("[%s] end rput file %s", req.ReqId, fileName)
-			}
+		if zipFile.FileInfo().IsDir() {
+			continue
+		}
 
-		} else {
-			unzipData, unzipErr := ioutil.ReadAll(zipFileReader)
-			if unzipErr != nil {
-				err = fmt.Errorf("unzip the file content failed, %s", unzipErr.Error())
-				zipFileReader.Close()
-				return
-			}
-			zipFileReader.Close()
-			unzipReader := bytes.NewReader(unzipData)
-
-			if fileSize <= RESUMABLE_PUT_THRESHOLD {
-				log.Infof("[%s] start to fput bytes %s", req.ReqId, fileName)
-				var fputRet fio.PutRet
-				fErr := fio.Put(nil, &fputRet, uptoken, fileKey, unzipReader, nil)
-				if fErr != nil {
-					if v, ok := fErr.(*rpc.ErrorInfo); ok {
-						unzipFile.Error = fmt.Sprintf("save unzip file to bucket error, %s", v.Err)
-					} else {
-						unzipFile.Error = fmt.Sprintf("save unzip file to bucket error, %s", fErr.Error())
-					}
-				} else {
-					unzipFile.Hash = fputRet.Hash
-				}
-				log.Infof("[%s] end fput bytes %s", req.ReqId, fileName)
-			} else {
-				log.Infof("[%s] start to rput bytes %s", req.ReqId, fileName)
-				var rputRet rio.PutRet
-				rErr := rio.Put(nil, &rputRet, uptoken, fileKey, unzipReader, int64(fileSize), nil)
-				if rErr != nil {
-					if v, ok := rErr.(*rpc.ErrorInfo); ok {
-						unzipFile.Error = fmt.Sprintf("save unzip file to bucket error, %s", v.Err)
-					} else {
-						unzipFile.Error = fmt.Sprintf("save unzip file to bucket error, %s", rErr.Error())
-					}
-				} else {
-					unzipFile.Hash = rputRet.Hash
-				}
-				log.Infof("[%s] end rput bytes %s", req.ReqId, fileName)
+		entry := zipEntry{
+			zipFile:  zipFile,
+			fileName: fileName,
+		}
+		entry.safeName, entry.rejectErr = sanitizeFileName(fileName, this.maxDirDepth)
+		if !params.selected(entry.fileName, entry.safeName) {
+			continue
+		}
+		if entry.rejectErr == nil {
+			var skip bool
+			entry.safeName, skip, entry.rejectErr = rewriter.rewrite(entry.safeName)
+			if skip {
+				continue
 			}
 		}
+		zipEntries = append(zipEntries, entry)
+	}
+	return
+}
 
-		unzipResult.Files = append(unzipResult.Files, unzipFile)
+// detect the charset of the names which are not flagged as utf8
+func detectFileNameCharset(zipFiles []*zip.File) string {
+	fileNames := make([]string, 0, len(zipFiles))
+	for _, zipFile := range zipFiles {
+		if zipFile.Flags&ZIP_FLAG_UTF8 == 0 {
+			fileNames = append(fileNames, zipFile.Name)
+		}
 	}
+	return utils.DetectCharset(fileNames)
+}
 
-	log.Infof("[%s] upload files done", req.ReqId)
-	//write result
-	result = unzipResult
-	resultType = ufop.RESULT_TYPE_JSON
-	contentType = ufop.CONTENT_TYPE_JSON
+// the names flagged as utf8 are kept, and the others are decoded in the charset
+func decodeFileName(zipFile *zip.File, charset string) (string, error) {
+	if zipFile.Flags&ZIP_FLAG_UTF8 != 0 {
+		return zipFile.Name, nil
+	}
+	return utils.DecodeString(charset, zipFile.Name)
+}
 
+// the pax names are always utf8, and the others are decoded in the charset, or in the charset detected
+// from the name itself when not specified
+func decodeTarFileName(tarHeader *tar.Header, charset string) (fileName string, err error) {
+	fileName = tarHeader.Name
+	if _, ok := tarHeader.PAXRecords["path"]; !ok {
+		if charset == "" {
+			charset = utils.DetectCharset([]string{fileName})
+		}
+		fileName, err = utils.DecodeString(charset, fileName)
+		if err != nil {
+			return
+		}
+	}
 	return
 }
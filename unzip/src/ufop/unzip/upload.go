@@ -0,0 +1,382 @@
+package unzip
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+	"time"
+	"ufop"
+	"ufop/store"
+
+	"github.com/qiniu/log"
+)
+
+// memoryBudget 限制并发上传时缓存在内存中的文件总大小
+type memoryBudget struct {
+	lock  sync.Mutex
+	cond  *sync.Cond
+	total int64
+	used  int64
+}
+
+func newMemoryBudget(total int64) *memoryBudget {
+	budget := &memoryBudget{
+		total: total,
+	}
+	budget.cond = sync.NewCond(&budget.lock)
+	return budget
+}
+
+// wait until the size is available, the size larger than the total budget is limited to the total budget,
+// return the size acquired which should be released later
+func (this *memoryBudget) acquire(size int64) int64 {
+	if size > this.total {
+		size = this.total
+	}
+	this.lock.Lock()
+	for this.used+size > this.total {
+		this.cond.Wait()
+	}
+	this.used += size
+	this.lock.Unlock()
+	return size
+}
+
+func (this *memoryBudget) release(size int64) {
+	this.lock.Lock()
+	this.used -= size
+	this.lock.Unlock()
+	this.cond.Broadcast()
+}
+
+// unzipUploader 并发上传解压出的文件，文件内容由调用方按照压缩包中的顺序读取，读取完成后交给上传协程，
+// 同时上传的文件数量不超过 workers，缓存在内存中的文件总大小不超过内存预算，
+// 内嵌的压缩包使用共享 workers 和内存预算的子 uploader，解压结果记录在压缩包对应的文件项中，
+// 上传完成的文件记录在检查点中，重新提交时跳过，names 由所有层级共享，记录 prefix 之后的文件名称对应的
+// 压缩包中的文件路径，用来检查内嵌压缩包中的文件和外层文件的名称冲突
+type unzipUploader struct {
+	unzipper  *Unzipper
+	req       ufop.UfopRequest
+	objStore  store.ObjectStore
+	prefix    string
+	overwrite bool
+
+	//the directory of the nested archive under the prefix, and the path of the nested archive
+	dir        string
+	archiveDir string
+	names      map[string]string
+
+	workers    chan struct{}
+	budget     *memoryBudget
+	sync       *unzipSync
+	checkpoint *unzipCheckpoint
+	wg         *sync.WaitGroup
+	files      []*UnzipFile
+	nested     map[*UnzipFile]*unzipUploader
+}
+
+// the existing files are always overwritten in the sync mode, because the unchanged ones are skipped
+func (this *Unzipper) newUploader(req ufop.UfopRequest, objStore store.ObjectStore, params UnzipParams,
+	syncState *unzipSync) *unzipUploader {
+	return &unzipUploader{
+		unzipper:   this,
+		req:        req,
+		objStore:   objStore,
+		prefix:     params.Prefix,
+		overwrite:  params.Overwrite || syncState != nil,
+		sync:       syncState,
+		checkpoint: this.newCheckpoint(req, params),
+		workers:    make(chan struct{}, this.uploadWorkers),
+		budget:     newMemoryBudget(this.uploadMemoryBudget),
+		wg:         &sync.WaitGroup{},
+		files:      make([]*UnzipFile, 0, 100),
+		nested:     make(map[*UnzipFile]*unzipUploader),
+		names:      make(map[string]string),
+	}
+}
+
+// record the nested archive and create the uploader of the files in it, the files are uploaded under the
+// directory named after the archive
+func (this *unzipUploader) nestedUploader(fileName, dirName string, fileSize int64,
+	modTime time.Time) (archiveFile *UnzipFile, nestedUploader *unzipUploader) {
+	archiveFile = &UnzipFile{
+		Key:    this.prefix + fileName,
+		Size:   fileSize,
+		Mtime:  formatModTime(modTime),
+		Status: UNZIP_FILE_STATUS_EXTRACTED,
+	}
+	uploaderCopy := *this
+	nestedUploader = &uploaderCopy
+	nestedUploader.prefix = this.prefix + dirName
+	nestedUploader.dir = this.dir + dirName
+	nestedUploader.archiveDir = this.archiveDir + fileName + "/"
+	nestedUploader.files = make([]*UnzipFile, 0, 100)
+	nestedUploader.nested = make(map[*UnzipFile]*unzipUploader)
+
+	this.files = append(this.files, archiveFile)
+	this.nested[archiveFile] = nestedUploader
+	return
+}
+
+// read the file item in the archive and upload it in background as the prefix plus the file name, the error is
+// returned only when the file item can not be read or exceeds the limits, and the upload error is recorded in
+// the result, the reader is wrapped by the guard to check the limits
+func (this *unzipUploader) upload(fileReader io.Reader, fileSize int64, fileName string,
+	modTime time.Time) (err error) {
+	reqId := this.req.ReqId
+	objStore := this.objStore
+	fileKey := this.prefix + fileName
+	unzipFile := &UnzipFile{
+		Key:   fileKey,
+		Mtime: formatModTime(modTime),
+	}
+
+	//the names are unique in each archive, but the files in the nested archive may conflict with the files in
+	//the outer archive, such as 'l1/a.html' and 'a.html' in 'l1.zip', the later one is rejected
+	name := this.dir + fileName
+	if conflictName, ok := this.names[name]; ok {
+		rejectErr := fmt.Errorf("name conflicts, '%s' is already used by file '%s'", name, conflictName)
+		log.Warnf("[%s] reject file %q, %s", reqId, this.archiveDir+fileName, rejectErr.Error())
+		this.reject(fileName, rejectErr)
+		return
+	}
+	this.names[name] = this.archiveDir + fileName
+
+	//skip the file uploaded before the job was interrupted
+	if this.checkpoint != nil {
+		if completedFile, ok := this.checkpoint.completed(fileKey, fileSize, unzipFile.Mtime); ok {
+			completedFile.Status = UNZIP_FILE_STATUS_RESUMED
+			this.files = append(this.files, &completedFile)
+			return
+		}
+	}
+
+	putExtra := store.PutExtra{
+		Overwrite: this.overwrite,
+		Headers:   this.unzipper.matchHeaders(fileName),
+	}
+
+	//wait for an idle worker, the worker and the resources are released here if the upload is not started
+	this.workers <- struct{}{}
+	var cleanups []func()
+	started := false
+	defer func() {
+		if !started {
+			for _, cleanup := range cleanups {
+				cleanup()
+			}
+			<-this.workers
+		}
+	}()
+
+	this.req.Job.SetPhase(ufop.JOB_PHASE_EXTRACTING)
+	//the size, crc32 and the header to detect the mime type are computed while reading
+	digest := newFileDigest(this.sync != nil)
+	zipFileContent := io.TeeReader(this.req.Job.Reader(fileReader), digest)
+	var put func() (store.PutRet, error)
+	var content func() io.Reader
+	if fileSize > UNZIP_CACHE_FILE_ITEM_THRESHOLD {
+		zipFileItemCacheFh, openErr := ioutil.TempFile("", "unzip_item_")
+		if openErr != nil {
+			err = fmt.Errorf("open local cache file item failed, %s", openErr.Error())
+			return
+		}
+		cleanups = append(cleanups, func() {
+			zipFileItemCacheFh.Close()
+			os.Remove(zipFileItemCacheFh.Name())
+		})
+
+		_, cpErr := io.Copy(zipFileItemCacheFh, zipFileContent)
+		if cpErr != nil {
+			if isGuardError(cpErr) {
+				err = cpErr
+			} else {
+				err = fmt.Errorf("write local cache file item failed, %s", cpErr.Error())
+			}
+			return
+		}
+
+		//the uploaded parts are recorded in the progress file, and skipped when retried
+		putExtra.ProgressFile = filepath.Join(this.unzipper.progressDir,
+			fmt.Sprintf("unzip_progress_%s_%x", reqId, md5.Sum([]byte(fileKey))))
+		cleanups = append(cleanups, func() {
+			os.Remove(putExtra.ProgressFile)
+		})
+
+		put = func() (store.PutRet, error) {
+			log.Infof("[%s] start to multipart put file %s", reqId, fileKey)
+			defer log.Infof("[%s] end multipart put file %s", reqId, fileKey)
+			return objStore.PutMultipart(this.req.Job.Context(), fileKey, zipFileItemCacheFh, fileSize, &putExtra)
+		}
+		content = func() io.Reader {
+			return io.NewSectionReader(zipFileItemCacheFh, 0, digest.size)
+		}
+	} else {
+		memSize := this.budget.acquire(fileSize)
+		cleanups = append(cleanups, func() {
+			this.budget.release(memSize)
+		})
+
+		unzipData, unzipErr := ioutil.ReadAll(zipFileContent)
+		if unzipErr != nil {
+			if isGuardError(unzipErr) {
+				err = unzipErr
+			} else {
+				err = fmt.Errorf("unzip the file content failed, %s", unzipErr.Error())
+			}
+			return
+		}
+
+		put = func() (store.PutRet, error) {
+			log.Infof("[%s] start to put bytes %s", reqId, fileKey)
+			defer log.Infof("[%s] end put bytes %s", reqId, fileKey)
+			return objStore.Put(this.req.Job.Context(), fileKey, bytes.NewReader(unzipData), int64(len(unzipData)),
+				&putExtra)
+		}
+		content = func() io.Reader {
+			return bytes.NewReader(unzipData)
+		}
+	}
+
+	digest.fill(unzipFile)
+	unzipFile.MimeType = this.unzipper.detectMimeType(fileKey, digest.header)
+	putExtra.MimeType = unzipFile.MimeType
+
+	//skip the file whose content is the same as the existing one in the sync mode
+	if this.sync != nil {
+		if existingHash, unchanged := this.sync.unchanged(fileKey, digest); unchanged {
+			unzipFile.Hash = existingHash
+			unzipFile.Status = UNZIP_FILE_STATUS_UNCHANGED
+			this.files = append(this.files, unzipFile)
+			return
+		}
+	}
+
+	this.files = append(this.files, unzipFile)
+	this.wg.Add(1)
+	started = true
+	go func() {
+		defer this.wg.Done()
+		defer func() {
+			for _, cleanup := range cleanups {
+				cleanup()
+			}
+			<-this.workers
+		}()
+		defer this.recoverPut(unzipFile)
+		this.put(unzipFile, put, content)
+	}()
+	return
+}
+
+// fail the file when the upload panics, the panic in the background upload can not be recovered by the job
+// handler, and would crash the whole process
+func (this *unzipUploader) recoverPut(unzipFile *UnzipFile) {
+	if v := recover(); v != nil {
+		log.Errorf("[%s] put file %s panic, %v\n%s", this.req.ReqId, unzipFile.Key, v, debug.Stack())
+		unzipFile.Status = UNZIP_FILE_STATUS_FAILED
+		unzipFile.Error = fmt.Sprintf("save unzip file to bucket error, panic: %v", v)
+	}
+}
+
+// record the file item rejected without uploading, the key is the original name in the archive
+func (this *unzipUploader) reject(fileName string, rejectErr error) {
+	this.files = append(this.files, &UnzipFile{
+		Key:    fileName,
+		Status: UNZIP_FILE_STATUS_REJECTED,
+		Error:  rejectErr.Error(),
+	})
+}
+
+// put the file with retries when failed with temporary errors, the content is read again to check the existing
+// file when the put fails because the file exists
+func (this *unzipUploader) put(unzipFile *UnzipFile, put func() (store.PutRet, error), content func() io.Reader) {
+	reqId := this.req.ReqId
+	job := this.req.Job
+
+	job.SetPhase(ufop.JOB_PHASE_UPLOADING)
+	putRet, putErr := put()
+	backoff := this.unzipper.uploadRetryBackoff
+	for putErr != nil && store.IsRetryable(putErr) && unzipFile.Retries < this.unzipper.uploadRetries {
+		log.Warnf("[%s] put file %s failed, retry after %ds, %s", reqId, unzipFile.Key, backoff, putErr.Error())
+		select {
+		case <-time.After(time.Duration(backoff) * time.Second):
+		case <-job.Context().Done():
+		}
+		if job.Err() != nil {
+			break
+		}
+		backoff *= 2
+		if backoff > UNZIP_UPLOAD_MAX_RETRY_BACKOFF {
+			backoff = UNZIP_UPLOAD_MAX_RETRY_BACKOFF
+		}
+
+		unzipFile.Retries += 1
+		putRet, putErr = put()
+	}
+	//the file may be stored by the failed attempt before the retry, such as the one timed out after uploaded, or by
+	//the job interrupted before the file was recorded in the checkpoint, the same content is not a conflict
+	if putErr == store.ErrExists {
+		if existingHash, ok := this.stored(unzipFile, content()); ok {
+			log.Infof("[%s] file %s is stored with the same content before", reqId, unzipFile.Key)
+			putErr = nil
+			putRet.Hash = existingHash
+		}
+	}
+
+	if putErr != nil {
+		unzipFile.Status = UNZIP_FILE_STATUS_FAILED
+		unzipFile.Error = fmt.Sprintf("save unzip file to bucket error, %s", putErr.Error())
+	} else {
+		unzipFile.Status = UNZIP_FILE_STATUS_UPLOADED
+		unzipFile.Hash = putRet.Hash
+		if this.checkpoint != nil {
+			this.checkpoint.record(reqId, *unzipFile)
+		}
+	}
+}
+
+// check whether the existing file has the same size and hash as the content
+func (this *unzipUploader) stored(unzipFile *UnzipFile, content io.Reader) (hash string, ok bool) {
+	info, statErr := this.objStore.Stat(this.req.Job.Context(), unzipFile.Key)
+	if statErr != nil || info.Fsize != unzipFile.Size {
+		return
+	}
+	digest := newFileDigest(true)
+	if _, cpErr := io.Copy(digest, content); cpErr != nil {
+		return
+	}
+	hash = info.Hash
+	ok = digest.matchHash(hash)
+	return
+}
+
+// wait for all the uploads in background
+func (this *unzipUploader) wait() {
+	this.wg.Wait()
+}
+
+// wait for all the uploads and add the results in the order of the files in the archive
+func (this *unzipUploader) collect(unzipResult *UnzipResult) {
+	this.wait()
+	for _, unzipFile := range this.collectFiles() {
+		unzipResult.addFile(unzipFile)
+	}
+}
+
+func (this *unzipUploader) collectFiles() []UnzipFile {
+	unzipFiles := make([]UnzipFile, 0, len(this.files))
+	for _, unzipFile := range this.files {
+		if nestedUploader, ok := this.nested[unzipFile]; ok {
+			unzipFile.Files = nestedUploader.collectFiles()
+		}
+		unzipFiles = append(unzipFiles, *unzipFile)
+	}
+	return unzipFiles
+}
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestLookupCharset(t *testing.T) {
+	cases := []struct {
+		name    string
+		charset string
+	}{
+		{"UTF-8", CHARSET_UTF8},
+		{" GB2312 ", CHARSET_GBK},
+		{"gb18030", CHARSET_GB18030},
+		{"cp950", CHARSET_BIG5},
+		{"SJIS", CHARSET_SHIFT_JIS},
+		{"cp949", CHARSET_EUC_KR},
+		{"ibm437", CHARSET_CP437},
+	}
+	for _, c := range cases {
+		charset, err := LookupCharset(c.name)
+		if err != nil || charset != c.charset {
+			t.Errorf("LookupCharset(%q) = %q, %v, want %q", c.name, charset, err, c.charset)
+		}
+	}
+	if _, err := LookupCharset("latin9"); err == nil {
+		t.Error("LookupCharset should fail for the unsupported charset")
+	}
+}
+
+func TestDetectCharset(t *testing.T) {
+	cases := []struct {
+		encoding string
+		names    []string
+		charset  string
+	}{
+		{CHARSET_UTF8, []string{"文档/说明.txt", "readme.md"}, CHARSET_UTF8},
+		{CHARSET_UTF8, []string{"readme.md", "src/main.go"}, CHARSET_UTF8},
+		//gbk is a subset of gb18030, so the names in gbk are detected as gb18030
+		{CHARSET_GBK, []string{"文档/说明.txt", "图片/照片.jpg"}, CHARSET_GB18030},
+		{CHARSET_GBK, []string{"课件/第一章.ppt"}, CHARSET_GB18030},
+		{CHARSET_GB18030, []string{"新建文件夹/会议记录.docx"}, CHARSET_GB18030},
+		{CHARSET_SHIFT_JIS, []string{"テスト/ファイル.txt", "議事録.pdf"}, CHARSET_SHIFT_JIS},
+		{CHARSET_SHIFT_JIS, []string{"資料/写真の一覧.xlsx"}, CHARSET_SHIFT_JIS},
+		{CHARSET_BIG5, []string{"說明文件.txt", "資料夾/檔案.doc"}, CHARSET_BIG5},
+		{CHARSET_EUC_KR, []string{"문서/사진.jpg", "보고서.hwp"}, CHARSET_EUC_KR},
+		{CHARSET_CP437, []string{"Café/Noël.txt"}, CHARSET_CP437},
+	}
+	for _, c := range cases {
+		names := make([]string, 0, len(c.names))
+		for _, name := range c.names {
+			encoded, err := EncodeString(c.encoding, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, encoded)
+		}
+		if charset := DetectCharset(names); charset != c.charset {
+			t.Errorf("DetectCharset(%q in %s) = %q, want %q", c.names, c.encoding, charset, c.charset)
+			continue
+		}
+		for index, name := range names {
+			if decoded, err := DecodeString(c.charset, name); err != nil || decoded != c.names[index] {
+				t.Errorf("DecodeString(%s, %q) = %q, %v, want %q", c.charset, name, decoded, err, c.names[index])
+			}
+		}
+	}
+}